@@ -0,0 +1,96 @@
+// +build linux freebsd dragonfly darwin
+
+package shpnetpoll
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"shpnetpoll/errors"
+)
+
+// activateForTest makes the current process look like one started by a socket-activating supervisor.
+func activateForTest(pid int, fds, names string) {
+	_ = os.Setenv("LISTEN_PID", strconv.Itoa(pid))
+	_ = os.Setenv("LISTEN_FDS", fds)
+	_ = os.Setenv("LISTEN_FDNAMES", names)
+	activation.once, activation.n, activation.names = sync.Once{}, 0, nil
+}
+
+func TestActivatedFd(t *testing.T) {
+	activateForTest(os.Getpid(), "3", "foo:bar:baz")
+	cases := []struct {
+		network, addr string
+		fd            int
+		err           error
+	}{
+		{"fd", "7", 7, nil},
+		{"fd", "-1", 0, errors.ErrInvalidListenerFd},
+		{"listen-fds", "", listenFdsStart, nil},
+		{"listen-fds", "2", listenFdsStart + 2, nil},
+		{"listen-fds", "3", 0, errors.ErrNoListenFds},
+		{"listen-fds", "bar", listenFdsStart + 1, nil},
+		{"listen-fds", "qux", 0, errors.ErrNoListenFds},
+	}
+	for _, tc := range cases {
+		if fd, err := activatedFd(tc.network, tc.addr); fd != tc.fd || err != tc.err {
+			t.Fatalf("%s://%s: expect fd %d and error %v but got %d and %v", tc.network, tc.addr, tc.fd, tc.err, fd, err)
+		}
+	}
+	for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if v, ok := os.LookupEnv(env); ok {
+			t.Fatalf("expect %s to be unset once taken but got %q", env, v)
+		}
+	}
+
+	// The fds are not meant for the current process.
+	activateForTest(os.Getpid()+1, "3", "")
+	if _, err := activatedFd("listen-fds", ""); err != errors.ErrNoListenFds {
+		t.Fatalf("expect %v for the fds of another process but got %v", errors.ErrNoListenFds, err)
+	}
+}
+
+func TestServeActivatedFd(t *testing.T) {
+	ln, fd := listenerFdForTest(t)
+	defer ln.Close()
+
+	h := newMigrationHandler()
+	_, stop := serveOnForTest(t, h, fmt.Sprintf("fd://%d", fd))
+	defer stop()
+	cli, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	select {
+	case <-h.opened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect the connection to the activated listener to be opened")
+	}
+}
+
+func TestRestartFromActivatedListener(t *testing.T) {
+	// The process restarted from the one activated by a supervisor inherits the environments meant for its parent.
+	ln, fd := listenerFdForTest(t)
+	defer ln.Close()
+	activateForTest(os.Getppid(), "1", "")
+	r := inheritForTest(t, map[string][]int{"listen-fds://": {fd}})
+	defer r.Close()
+
+	l, err := initListener("listen-fds", "", &Options{})
+	if err != nil {
+		t.Fatalf("expect the listener handed over by parent to be taken but got %v", err)
+	}
+	defer l.close()
+	if !l.activated || l.activatedAs != "listen-fds://" || l.addr != ln.Addr().String() {
+		t.Fatalf("expect an activated listener on %s but got %s activated as %q", ln.Addr(), l.addr, l.activatedAs)
+	}
+	if _, ok := os.LookupEnv("LISTEN_PID"); ok {
+		t.Fatal("expect LISTEN_PID to be unset once taken")
+	}
+}
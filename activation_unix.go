@@ -0,0 +1,144 @@
+// +build linux freebsd dragonfly darwin
+
+package shpnetpoll
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+	"shpnetpoll/errors"
+)
+
+// listenFdsStart is the first fd passed in by a socket-activating supervisor, like SD_LISTEN_FDS_START of systemd.
+const listenFdsStart = 3
+
+// activation holds the fds passed in by a socket-activating supervisor.
+var activation struct {
+	once  sync.Once
+	n     int      // number of fds, 0 if there are none for the current process
+	names []string // names of fds
+}
+
+// loadActivation parses LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES, the environments are unset so that they won't leak
+// into the other processes started by the current one, like the one started by Restart.
+func loadActivation() {
+	pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	if p, err := strconv.Atoi(pid); err != nil || p != os.Getpid() {
+		return
+	}
+	if n, err := strconv.Atoi(fds); err == nil && n > 0 {
+		activation.n = n
+	}
+	if names != "" {
+		activation.names = strings.Split(names, ":")
+	}
+}
+
+// listenFds returns the number of fds passed in by a socket-activating supervisor via LISTEN_FDS,
+// along with their names in LISTEN_FDNAMES. The fds are only meant for the process identified by LISTEN_PID.
+func listenFds() (n int, names []string, err error) {
+	activation.once.Do(loadActivation)
+	if activation.n == 0 {
+		return 0, nil, errors.ErrNoListenFds
+	}
+	return activation.n, activation.names, nil
+}
+
+// activatedFd returns the fd referred by an address of fd or listen-fds network:
+//
+//	fd://N           - the fd numbered N
+//	listen-fds://    - the first fd in LISTEN_FDS
+//	listen-fds://N   - the N-th fd in LISTEN_FDS, counting from 0
+//	listen-fds://foo - the fd named foo in LISTEN_FDNAMES
+func activatedFd(network, addr string) (int, error) {
+	if network == "fd" {
+		fd, err := strconv.Atoi(addr)
+		if err != nil || fd < 0 {
+			return 0, errors.ErrInvalidListenerFd
+		}
+		return fd, nil
+	}
+
+	n, names, err := listenFds()
+	if err != nil {
+		return 0, err
+	}
+	if addr == "" {
+		return listenFdsStart, nil
+	}
+	if i, err := strconv.Atoi(addr); err == nil {
+		if i < 0 || i >= n {
+			return 0, errors.ErrNoListenFds
+		}
+		return listenFdsStart + i, nil
+	}
+	for i, name := range names {
+		if name == addr && i < n {
+			return listenFdsStart + i, nil
+		}
+	}
+	return 0, errors.ErrNoListenFds
+}
+
+// activatedListener wraps the listening socket passed in by a socket-activating supervisor into a listener,
+// its network is figured out from the socket itself. The socket handed over by the parent on hot restart goes
+// first, the supervisor has passed it in for the parent rather than the current process.
+func activatedListener(network, addr string, options *Options) (*listener, error) {
+	activation.once.Do(loadActivation)
+	fd, handedOver := takeInheritedFd(network, addr)
+	if !handedOver {
+		var err error
+		if fd, err = activatedFd(network, addr); err != nil {
+			return nil, err
+		}
+	}
+	l, err := activatedFileListener(fd, options)
+	if err != nil {
+		if handedOver {
+			_ = unix.Close(fd)
+		}
+		return nil, err
+	}
+	l.activatedAs = network + "://" + addr
+	return l, nil
+}
+
+// activatedFileListener wraps the listening socket fd into a listener of the network figured out from the socket.
+func activatedFileListener(fd int, options *Options) (*listener, error) {
+	var network string
+
+	soType, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TYPE)
+	if err != nil {
+		return nil, os.NewSyscallError("getsockopt", err)
+	}
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return nil, os.NewSyscallError("getsockname", err)
+	}
+	switch _, isUnix := sa.(*unix.SockaddrUnix); {
+	case isUnix:
+		network = "unix"
+	case soType == unix.SOCK_DGRAM:
+		network = "udp"
+	default:
+		network = "tcp"
+	}
+
+	l, err := fileListener(network, "", fd, options)
+	if err != nil {
+		return nil, err
+	}
+	if l.lnaddr != nil {
+		l.addr = l.lnaddr.String()
+	}
+	l.activated = true
+	unix.CloseOnExec(fd)
+	return l, nil
+}
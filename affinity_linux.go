@@ -0,0 +1,54 @@
+package shpnetpoll
+
+import (
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// cpu returns the CPU which the event-loop is pinned on by Options.CPUAffinity.
+func (el *eventloop) cpu() (int, bool) {
+	cpus := el.svr.opts.CPUAffinity
+	if len(cpus) == 0 || el.idx < 0 {
+		return 0, false
+	}
+	return cpus[el.idx%len(cpus)], true
+}
+
+// lockOSThread wires the goroutine of event-loop to its OS thread if lockOSThread is true or the event-loop has
+// a CPU assigned, and pins the thread on that CPU in the latter case. The returned function must be called when the
+// event-loop exits: a pinned thread is never handed back to the Go runtime, it's terminated along with the goroutine.
+func (el *eventloop) lockOSThread(lockOSThread bool) (unlock func()) {
+	cpu, ok := el.cpu()
+	if !lockOSThread && !ok {
+		return func() {}
+	}
+
+	runtime.LockOSThread()
+	if !ok {
+		return runtime.UnlockOSThread
+	}
+	var set unix.CPUSet
+	set.Set(cpu)
+	if err := unix.SchedSetaffinity(0, &set); err != nil {
+		el.svr.logger.Warnf("failed to pin event-loop(%d) on CPU %d: %v", el.idx, cpu,
+			os.NewSyscallError("sched_setaffinity", err))
+		return runtime.UnlockOSThread
+	}
+	return func() {}
+}
+
+// steerIncomingCPU asks the kernel to prefer the listener bound in ReusePort mode for the connections and datagrams
+// received on the CPU which the event-loop is pinned on, so that the softirq processing of packets and the event-loop
+// share the same CPU.
+func (el *eventloop) steerIncomingCPU(ln *listener) {
+	cpu, ok := el.cpu()
+	if !ok {
+		return
+	}
+	if err := unix.SetsockoptInt(ln.fd, unix.SOL_SOCKET, unix.SO_INCOMING_CPU, cpu); err != nil {
+		el.svr.logger.Warnf("failed to steer the incoming CPU of %s://%s to %d: %v", ln.network, ln.addr, cpu,
+			os.NewSyscallError("setsockopt", err))
+	}
+}
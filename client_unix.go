@@ -0,0 +1,187 @@
+// +build linux freebsd dragonfly darwin
+
+package shpnetpoll
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+	"shpnetpoll/errors"
+	"shpnetpoll/internal"
+	"shpnetpoll/internal/logging"
+	"shpnetpoll/internal/netpoll"
+	"shpnetpoll/internal/reuseport"
+	prb "shpnetpoll/pool/ringbuffer"
+)
+
+// Client dials outbound connections and drives them with its own event-loops,
+// the events of those connections are delivered to the EventHandler just like the ones of server.
+type Client struct {
+	svr  *server       // internal server which owns the event-loops
+	done chan struct{} // closed when all event-loops of client have been shut down
+}
+
+// NewClient instantiates a client with the given event handler and options,
+// Start must be called before dialing any connection.
+func NewClient(eventHandler EventHandler, opts ...Option) (cli *Client, err error) {
+	options := loadOptions(opts...)
+
+	if options.Logger != nil {
+		logging.DefaultLogger = options.Logger
+	}
+
+	if options.LockOSThread && options.NumEventLoop > 10000 {
+		logging.DefaultLogger.Errorf("too many event-loops under LockOSThread mode, should be less than 10,000 "+
+			"while you are trying to set up %d\n", options.NumEventLoop)
+		return nil, errors.ErrTooManyEventLoopThreads
+	}
+
+	if rbc := options.ReadBufferCap; rbc <= 0 {
+		options.ReadBufferCap = 0x4000
+	} else {
+		options.ReadBufferCap = internal.CeilToPowerOfTwo(rbc)
+	}
+
+	if low := options.OutboundLowWatermark; low <= 0 || low > options.OutboundHighWatermark {
+		options.OutboundLowWatermark = options.OutboundHighWatermark / 2
+	}
+
+	svr := newServer(eventHandler, options)
+	for i, n := 0, numEventLoops(options); i < n; i++ {
+		if _, err = svr.openEventLoop(); err != nil {
+			svr.closeEventLoops()
+			return nil, err
+		}
+	}
+
+	return &Client{svr: svr, done: make(chan struct{})}, nil
+}
+
+// Start starts the event-loops of client in background.
+func (cli *Client) Start() error {
+	svr := cli.svr
+	s := Server{
+		svr:          svr,
+		Multicore:    svr.opts.Multicore,
+		NumEventLoop: svr.lb.len(),
+		TCPKeepAlive: svr.opts.TCPKeepAlive,
+	}
+	switch svr.eventHandler.OnInitComplete(s) {
+	case None:
+	case Shutdown:
+		svr.closeEventLoops()
+		close(cli.done)
+		return nil
+	}
+
+	svr.lb.iterate(func(i int, el *eventloop) bool {
+		if el.idx == 0 && svr.opts.Ticker {
+			go el.loopTicker()
+		}
+		return true
+	})
+	svr.scaleMu.Lock()
+	svr.startSubReactors()
+	svr.scaleStarted = true
+	svr.scaleMu.Unlock()
+	if svr.opts.SlowCallbackThreshold > 0 {
+		go svr.watchSlowCallbacks()
+	}
+
+	go func() {
+		svr.stop(s)
+		close(cli.done)
+	}()
+	return nil
+}
+
+// Stop closes all connections of client and shuts its event-loops down, it blocks until they are all exited.
+func (cli *Client) Stop() error {
+	if cli.svr.isInShutdown() {
+		return errors.ErrServerInShutdown
+	}
+	cli.svr.signalShutdown()
+	<-cli.done
+	return nil
+}
+
+// Stats returns a snapshot of the metrics of client and its event-loops.
+func (cli *Client) Stats() Stats {
+	return cli.svr.stats()
+}
+
+// Dial connects to the address on the named network, "tcp", "tcp4", "tcp6" and "unix" are supported.
+//
+// Dial never blocks: the connection is established in background by one of event-loops chosen via
+// the load-balancer, OnOpened fires once it is connected, or OnClosed fires with the error if it fails.
+// Data passed to Conn.AsyncWrite before that will be sent right after the connection is opened.
+func (cli *Client) Dial(network, address string) (Conn, error) {
+	fd, remoteAddr, err := reuseport.Connect(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	el := cli.svr.lb.next(remoteAddr)
+	if el == nil {
+		_ = unix.Close(fd)
+		return nil, errors.ErrNoEventLoop
+	}
+	c := &conn{
+		fd:             fd,
+		loop:           el,
+		codec:          cli.svr.codec,
+		connecting:     true,
+		remoteAddr:     remoteAddr,
+		inboundBuffer:  prb.Get(),
+		outboundBuffer: prb.Get(),
+	}
+	err = el.poller.UrgentTrigger(func() error {
+		return el.loopRegister(c)
+	})
+	if err != nil {
+		_ = unix.Close(fd)
+		c.releaseTCP()
+		return nil, err
+	}
+	return c, nil
+}
+
+// loopConnect finishes a non-blocking connect when the socket becomes writable.
+func (el *eventloop) loopConnect(c *conn) error {
+	errno, err := unix.GetsockoptInt(c.fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err == nil && errno != 0 {
+		err = unix.Errno(errno)
+	}
+	if err != nil {
+		return el.loopConnectFailed(c, os.NewSyscallError("connect", err))
+	}
+
+	c.connecting = false
+	if sa, err := unix.Getsockname(c.fd); err == nil {
+		c.localAddr = netpoll.SockaddrToTCPOrUnixAddr(sa)
+	}
+	if c.localAddr != nil && c.localAddr.Network() == "tcp" {
+		_ = netpoll.SetNoDelay(c.fd, el.svr.opts.TCPNoDelay == TCPNoDelay)
+		_ = netpoll.SetKeepAlive(c.fd, el.svr.opts.TCPKeepAlive)
+	}
+
+	// Stop watching the writable events unless some data are waiting to be sent.
+	if !c.hasPendingOutbound() {
+		_ = el.modRead(c)
+	}
+	return el.loopOpen(c)
+}
+
+// loopConnectFailed tears down a connection which has never been opened and reports the error via OnClosed.
+func (el *eventloop) loopConnectFailed(c *conn, err error) error {
+	c.connecting = false
+	_ = el.poller.Delete(c.fd)
+	_ = unix.Close(c.fd)
+	delete(el.connections, c.fd)
+	action := el.eventHandler.OnClosed(c, err)
+	c.releaseTCP()
+	if action == Shutdown {
+		return errors.ErrServerShutdown
+	}
+	return nil
+}
@@ -155,6 +155,9 @@ type DecoderConfig struct {
 	LengthAdjustment int
 	// InitialBytesToStrip is the number of first bytes to strip out from the decoded frame
 	InitialBytesToStrip int
+	// MaxFrameLength is the maximum length of frame including the header and the length field, the decoding fails
+	// with ErrFrameTooLarge as soon as the length field announces a longer frame, 0 means no limit.
+	MaxFrameLength int
 }
 
 // Encode ...
@@ -199,6 +202,9 @@ func (cc *LengthFieldBasedFrameCodec) Encode(c Conn, buf []byte) (out []byte, er
 	return
 }
 
+// maxInt is the maximum value of int.
+const maxInt = int(^uint(0) >> 1)
+
 type innerBuffer []byte
 
 func (in *innerBuffer) readN(n int) (buf []byte, err error) {
@@ -236,8 +242,20 @@ func (cc *LengthFieldBasedFrameCodec) Decode(c Conn) ([]byte, error) {
 		return nil, err
 	}
 
-	// real message length
+	// real message length, the length field comes from the peer and must not be trusted.
+	if frameLength > uint64(maxInt) {
+		return nil, errorset.ErrFrameTooLarge
+	}
 	msgLength := int(frameLength) + cc.decoderConfig.LengthAdjustment
+	if msgLength < 0 {
+		if cc.decoderConfig.LengthAdjustment > 0 {
+			return nil, errorset.ErrFrameTooLarge
+		}
+		return nil, errorset.ErrTooLessLength
+	}
+	if maxLength := cc.decoderConfig.MaxFrameLength; maxLength > 0 && msgLength > maxLength-len(header)-len(lenBuf) {
+		return nil, errorset.ErrFrameTooLarge
+	}
 	msg, err := in.readN(msgLength)
 	if err != nil {
 		return nil, errorset.ErrUnexpectedEOF
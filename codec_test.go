@@ -0,0 +1,109 @@
+package shpnetpoll
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	errorset "shpnetpoll/errors"
+)
+
+// bufferConn is a Conn which only serves the buffered data to a codec.
+type bufferConn struct {
+	Conn
+	buf []byte
+}
+
+func (c *bufferConn) Read() []byte { return c.buf }
+
+func (c *bufferConn) ShiftN(n int) int {
+	c.buf = c.buf[n:]
+	return n
+}
+
+func TestLengthFieldBasedFrameCodecDecode(t *testing.T) {
+	cases := []struct {
+		name   string
+		config DecoderConfig
+		input  []byte
+		frame  []byte
+		err    error
+	}{
+		{
+			name:   "no limit",
+			config: DecoderConfig{ByteOrder: binary.BigEndian, LengthFieldLength: 2},
+			input:  []byte{0, 3, 'a', 'b', 'c', 'd'},
+			frame:  []byte{0, 3, 'a', 'b', 'c'},
+		},
+		{
+			name:   "frame of the maximum length",
+			config: DecoderConfig{ByteOrder: binary.BigEndian, LengthFieldLength: 2, MaxFrameLength: 5},
+			input:  []byte{0, 3, 'a', 'b', 'c'},
+			frame:  []byte{0, 3, 'a', 'b', 'c'},
+		},
+		{
+			name:   "frame over the maximum length",
+			config: DecoderConfig{ByteOrder: binary.BigEndian, LengthFieldLength: 2, MaxFrameLength: 4},
+			input:  []byte{0, 3, 'a', 'b', 'c'},
+			err:    errorset.ErrFrameTooLarge,
+		},
+		{
+			name: "maximum length counts the header",
+			config: DecoderConfig{
+				ByteOrder: binary.BigEndian, LengthFieldOffset: 1, LengthFieldLength: 1, MaxFrameLength: 4,
+			},
+			input: []byte{'h', 3, 'a', 'b', 'c'},
+			err:   errorset.ErrFrameTooLarge,
+		},
+		{
+			name:   "announced frame over the maximum length before it arrives",
+			config: DecoderConfig{ByteOrder: binary.BigEndian, LengthFieldLength: 4, MaxFrameLength: 1024},
+			input:  []byte{0x7f, 0xff, 0xff, 0xff},
+			err:    errorset.ErrFrameTooLarge,
+		},
+		{
+			name:   "length field over int",
+			config: DecoderConfig{ByteOrder: binary.BigEndian, LengthFieldLength: 8},
+			input:  []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			err:    errorset.ErrFrameTooLarge,
+		},
+		{
+			name: "adjustment overflows int",
+			config: DecoderConfig{
+				ByteOrder: binary.BigEndian, LengthFieldLength: 8, LengthAdjustment: 1,
+			},
+			input: []byte{0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			err:   errorset.ErrFrameTooLarge,
+		},
+		{
+			name: "negative adjusted length",
+			config: DecoderConfig{
+				ByteOrder: binary.BigEndian, LengthFieldLength: 1, LengthAdjustment: -2,
+			},
+			input: []byte{1, 'a'},
+			err:   errorset.ErrTooLessLength,
+		},
+		{
+			name:   "incomplete frame",
+			config: DecoderConfig{ByteOrder: binary.BigEndian, LengthFieldLength: 2, MaxFrameLength: 16},
+			input:  []byte{0, 3, 'a'},
+			err:    errorset.ErrUnexpectedEOF,
+		},
+	}
+
+	for _, tc := range cases {
+		cc := NewLengthFieldBasedFrameCodec(EncoderConfig{}, tc.config)
+		c := &bufferConn{buf: tc.input}
+		frame, err := cc.Decode(c)
+		if err != tc.err {
+			t.Fatalf("%s: expect error %v but got %v", tc.name, tc.err, err)
+		}
+		if !bytes.Equal(frame, tc.frame) {
+			t.Fatalf("%s: expect frame %q but got %q", tc.name, tc.frame, frame)
+		}
+		if err != nil && len(c.buf) != len(tc.input) {
+			t.Fatalf("%s: expect the buffer to be untouched on error but %d bytes were shifted",
+				tc.name, len(tc.input)-len(c.buf))
+		}
+	}
+}
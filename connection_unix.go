@@ -5,9 +5,14 @@ package shpnetpoll
 import (
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/sys/unix"
+	"shpnetpoll/errors"
 	"shpnetpoll/internal/netpoll"
+	"shpnetpoll/internal/timingwheel"
 	"shpnetpoll/pool/bytebuffer"
 	prb "shpnetpoll/pool/ringbuffer"
 	"shpnetpoll/ringbuffer"
@@ -21,14 +26,52 @@ type conn struct {
 	codec          ICodec                 // codec for TCP
 	buffer         []byte                 // reuse memory of inbound data as a temporary buffer
 	opened         bool                   // connection opened event fired
+	connecting     bool                   // non-blocking connect in progress, only for client connections
+	closing        bool                   // close the connection once the outbound data are flushed
+	readPaused     bool                   // reading paused by PauseRead
+	unwritable     bool                   // outbound buffer beyond the high watermark, reading paused until it's drained
+	inboundBytes   int                    // bytes of inbound buffer accounted to the event-loop and the memory budget
+	replies        []*offloadReply        // replies waiting for the frames offloaded to the worker pool, in request order
+	inflight       int                    // number of offloaded frames whose replies are not done yet
+	reactPending   bool                   // frames may be left in buffers since the in-flight limit of offloads was reached
+	migrating      bool                   // handed over to another event-loop but not adopted by it yet, guarded by taskMu
 	localAddr      net.Addr               // local addr
 	remoteAddr     net.Addr               // remote addr
 	byteBuffer     *bytebuffer.ByteBuffer // bytes buffer for buffering current packet and data in ring-buffer
 	inboundBuffer  *ringbuffer.RingBuffer // buffer for data from client
 	outboundBuffer *ringbuffer.RingBuffer // buffer for data that is ready to write to client
+	lastActive     time.Time              // last time data were read or written, only tracked with idle timeout
+	idleTimer      *timingwheel.Timer     // timer of idle timeout
+	readTimer      *timingwheel.Timer     // timer of read deadline
+	writeTimer     *timingwheel.Timer     // timer of write deadline
+	readDeadline   time.Time              // read deadline, zero if not set or data have been read since
+	writeDeadline  time.Time              // write deadline, zero if not set
+	files          []*fileSegment         // file segments waiting to be sent by sendfile(2)
+	filesPre       int                    // number of bytes in outbound buffer which precede the last file segment
+	taskMu         sync.Mutex             // guards loop against the migration when triggering tasks
+	tasks          []connTask             // tasks triggered during the migration, run after the connection is adopted
+	staleTasks     int                    // number of tasks at the head of tasks, which were forwarded by former event-loop
+	triggered      uint64                 // number of tasks triggered in the normal lane, guarded by taskMu
+	ranTasks       uint64                 // number of tasks triggered in the normal lane which have run
+	closeAfter     uint64                 // value of ranTasks which the pending Close waits for, 0 if there is none
 }
 
-func newTCPConn(fd int, el *eventloop, sa unix.Sockaddr, remoteAddr net.Addr) *conn {
+// connTask is a task run for connection in its event-loop.
+type connTask func(el *eventloop) error
+
+// fileSegment is a segment of file queued in the outbound path of connection.
+type fileSegment struct {
+	fd     int   // duplicated file descriptor of file
+	offset int64 // offset of the next byte to send
+	remain int64 // number of bytes left to send
+	pre    int   // number of bytes in outbound buffer between the previous file segment and this one
+}
+
+// maxSendfileSize is the maximum number of bytes sent by one sendfile(2),
+// which prevents a large file from monopolizing the event-loop.
+const maxSendfileSize = 4 << 20
+
+func newTCPConn(fd int, el *eventloop, ln *listener, sa unix.Sockaddr, remoteAddr net.Addr) *conn {
 	c := &conn{
 		fd:             fd,
 		sa:             sa,
@@ -37,10 +80,10 @@ func newTCPConn(fd int, el *eventloop, sa unix.Sockaddr, remoteAddr net.Addr) *c
 		inboundBuffer:  prb.Get(),
 		outboundBuffer: prb.Get(),
 	}
-	c.localAddr = el.ln.lnaddr
+	c.localAddr = ln.lnaddr
 	c.remoteAddr = remoteAddr
 
-	if el.svr.ln.network != "tcp" {
+	if ln.network != "tcp" {
 		return c
 	}
 
@@ -57,6 +100,298 @@ func newTCPConn(fd int, el *eventloop, sa unix.Sockaddr, remoteAddr net.Addr) *c
 
 var emptyBuffer = ringbuffer.New(0)
 
+// trigger runs the task in the event-loop of connection asynchronously, the tasks triggered for the same connection
+// run in order even if it's migrated to another event-loop in the meantime.
+func (c *conn) trigger(task connTask) error {
+	return c.triggerTask(task, false)
+}
+
+// triggerUrgent is trigger in the high-priority lane of event-loop, the task is never rejected and runs ahead of
+// the tasks triggered before, except while the connection is being migrated.
+func (c *conn) triggerUrgent(task connTask) error {
+	return c.triggerTask(task, true)
+}
+
+func (c *conn) triggerTask(task connTask, urgent bool) (err error) {
+	if !urgent {
+		inner := task
+		task = func(el *eventloop) error { return el.loopRunTask(c, inner) }
+	}
+	c.taskMu.Lock()
+	defer c.taskMu.Unlock()
+	defer func() {
+		if err == nil && !urgent {
+			c.triggered++
+		}
+	}()
+	if c.migrating {
+		c.tasks = append(c.tasks, task)
+		return nil
+	}
+	el := c.loop
+	trigger := el.poller.Trigger
+	if urgent {
+		trigger = el.poller.UrgentTrigger
+	}
+	return trigger(func() error {
+		// The event-loop which has adopted the connection may be migrating it again in the meantime.
+		c.taskMu.Lock()
+		if c.loop == el {
+			c.taskMu.Unlock()
+			return task(el)
+		}
+		// The connection has been migrated since the task was triggered, it runs ahead of the tasks triggered after.
+		el.forwarded++
+		c.tasks = append(c.tasks, nil)
+		copy(c.tasks[c.staleTasks+1:], c.tasks[c.staleTasks:])
+		c.tasks[c.staleTasks] = task
+		c.staleTasks++
+		c.taskMu.Unlock()
+		return nil
+	})
+}
+
+// touch records the activity on connection for the idle timeout.
+func (c *conn) touch() {
+	if c.idleTimer != nil {
+		c.lastActive = time.Now()
+	}
+}
+
+// hasPendingOutbound reports whether there are data or files waiting to be written to the peer.
+func (c *conn) hasPendingOutbound() bool {
+	return !c.outboundBuffer.IsEmpty() || len(c.files) > 0
+}
+
+// bufferOutbound appends data to the outbound buffer and accounts them to the event-loop. The connection is closed
+// instead if the data would exceed the limits of buffers, the caller must check whether it's still open after that.
+func (c *conn) bufferOutbound(buf []byte) error {
+	if err := c.checkOutbound(len(buf)); err != nil {
+		return c.loop.loopCloseConn(c, err)
+	}
+	n, _ := c.outboundBuffer.Write(buf)
+	c.accountOutbound(n)
+	if high := c.loop.svr.opts.OutboundHighWatermark; high > 0 && !c.unwritable && c.outboundBuffer.Length() > high {
+		c.setWritable(false)
+	}
+	return nil
+}
+
+// accountOutbound adds n bytes to the outbound buffers accounted to the event-loop and the memory budget.
+func (c *conn) accountOutbound(n int) {
+	el := c.loop
+	el.counters.observeOutbound(atomic.AddInt64(&el.outboundBytes, int64(n)))
+	atomic.AddInt64(&el.svr.bufferedBytes, int64(n))
+}
+
+// accountInbound brings the inbound buffer accounted to the event-loop and the memory budget up to the given length,
+// it's called after the inbound buffer is changed by reading data or by the event handlers. It returns the number of
+// bytes by which the inbound buffer has grown, negative if it has shrunk.
+func (c *conn) accountInbound(length int) (grown int) {
+	if grown = length - c.inboundBytes; grown != 0 {
+		c.inboundBytes = length
+		atomic.AddInt64(&c.loop.inboundBytes, int64(grown))
+		atomic.AddInt64(&c.loop.svr.bufferedBytes, int64(grown))
+	}
+	return
+}
+
+// checkOutbound returns the error of the limit exceeded by appending n bytes to the outbound buffer, if any.
+func (c *conn) checkOutbound(n int) error {
+	svr := c.loop.svr
+	if limit := svr.opts.MaxOutboundBuffer; limit > 0 && c.outboundBuffer.Length()+n > limit {
+		return errors.ErrOutboundBufferExceeded
+	}
+	if budget := svr.opts.MemoryBudget; budget > 0 && atomic.LoadInt64(&svr.bufferedBytes)+int64(n) > budget {
+		return errors.ErrMemoryBudgetExceeded
+	}
+	return nil
+}
+
+// checkInbound returns the error of the limit exceeded by the inbound buffer after it has grown by the given bytes,
+// if any. The memory budget is only charged to the connection whose inbound buffer has grown, since the bytes
+// buffered by the others are not its fault.
+func (c *conn) checkInbound(grown int) error {
+	svr := c.loop.svr
+	if limit := svr.opts.MaxInboundBuffer; limit > 0 && c.inboundBuffer.Length() > limit {
+		return errors.ErrInboundBufferExceeded
+	}
+	if budget := svr.opts.MemoryBudget; budget > 0 && grown > 0 && atomic.LoadInt64(&svr.bufferedBytes) > budget {
+		return errors.ErrMemoryBudgetExceeded
+	}
+	return nil
+}
+
+// isReadPaused reports whether reading from connection is paused by PauseRead, the high watermark or
+// the in-flight limit of offloads.
+func (c *conn) isReadPaused() bool {
+	return c.readPaused || c.unwritable || c.offloadsFull()
+}
+
+// setWritable changes the writability of connection, which pauses or resumes reading from it, and fires
+// OnWritabilityChanged of EventHandler, if any, in a task since the connection may be in the middle of writing.
+func (c *conn) setWritable(writable bool) {
+	paused := c.isReadPaused()
+	c.unwritable = !writable
+	if paused != c.isReadPaused() {
+		_ = c.loop.watchRead(c)
+	}
+	h, ok := c.loop.eventHandler.(writabilityWatcher)
+	if !ok {
+		return
+	}
+	_ = c.triggerUrgent(func(el *eventloop) error {
+		if !c.opened {
+			return nil
+		}
+		return el.handleAction(c, h.OnWritabilityChanged(c, writable))
+	})
+}
+
+// wrote accounts the bytes written to the socket, and the write which failed to send all of data.
+func (c *conn) wrote(n int, partial bool) {
+	el := c.loop
+	if n > 0 {
+		atomic.AddUint64(&el.counters.bytesWritten, uint64(n))
+	}
+	if partial {
+		atomic.AddUint64(&el.counters.partialWrites, 1)
+	}
+}
+
+// flushOutbound writes at most n bytes from the outbound buffer to the socket. If the poller completes the sends,
+// it takes the bytes sent by the last send first and sends the rest in background, which fails with unix.EAGAIN
+// until the send is completed.
+func (c *conn) flushOutbound(n int) (int, error) {
+	var sent int
+	if cp := c.loop.completer; cp != nil {
+		var err error
+		if sent, err = cp.Sent(c.fd); err != nil {
+			if err != unix.EAGAIN {
+				c.wrote(0, false)
+			}
+			return 0, err
+		}
+		if sent > 0 {
+			c.flushed(sent, sent < n)
+			if n -= sent; n <= 0 {
+				return sent, nil
+			}
+		}
+		if head, tail := c.outboundBuffer.LazyRead(n); cp.Send(c.fd, head, tail) {
+			if sent > 0 {
+				return sent, nil
+			}
+			return 0, unix.EAGAIN
+		}
+		// No registered buffer is left, write in place.
+	}
+
+	head, tail := c.outboundBuffer.LazyRead(n)
+	var (
+		written int
+		err     error
+	)
+	// Flush both parts of the ring-buffer in one system call when the data wraps around.
+	if tail == nil {
+		written, err = unix.Write(c.fd, head)
+	} else {
+		written, err = unix.Writev(c.fd, [][]byte{head, tail})
+	}
+	if err != nil {
+		if err == unix.EAGAIN && sent > 0 {
+			return sent, nil
+		}
+		c.wrote(0, err == unix.EAGAIN)
+		return 0, err
+	}
+	c.flushed(written, written < n)
+	return sent + written, nil
+}
+
+// flushed drops the n bytes written to the socket from the outbound buffer, partial tells whether the write failed to
+// send all of data.
+func (c *conn) flushed(n int, partial bool) {
+	c.wrote(n, partial)
+	c.outboundBuffer.Shift(n)
+	c.accountOutbound(-n)
+	c.touch()
+	if c.unwritable && c.outboundBuffer.Length() <= c.loop.svr.opts.OutboundLowWatermark {
+		c.setWritable(true)
+	}
+}
+
+// sendOutbound starts sending the outbound buffer by the poller which completes the sends, the rest of it is sent
+// once the send is completed.
+func (c *conn) sendOutbound() error {
+	if _, err := c.flushOutbound(c.outboundBuffer.Length()); err != nil && err != unix.EAGAIN {
+		return c.loop.loopCloseConn(c, os.NewSyscallError("write", err))
+	}
+	if c.hasPendingOutbound() {
+		return c.loop.modReadWrite(c)
+	}
+	return nil
+}
+
+func (c *conn) releaseFiles() {
+	for i, seg := range c.files {
+		_ = unix.Close(seg.fd)
+		c.files[i] = nil
+	}
+	c.files = c.files[:0]
+	c.filesPre = 0
+}
+
+func (c *conn) stopTimers() {
+	c.idleTimer.Stop()
+	c.readTimer.Stop()
+	c.writeTimer.Stop()
+	c.idleTimer, c.readTimer, c.writeTimer = nil, nil, nil
+}
+
+// resumeTimers arms the timers of connection again in its event-loop after it's migrated.
+func (c *conn) resumeTimers() {
+	el := c.loop
+	if idleTimeout := el.svr.opts.IdleTimeout; idleTimeout > 0 {
+		c.idleTimer = el.timer.AfterFunc(idleTimeout-time.Since(c.lastActive), func() error {
+			return el.loopIdleTimeout(c)
+		})
+	}
+	c.armReadTimer()
+	c.armWriteTimer()
+}
+
+// armReadTimer (re-)arms the timer of read deadline.
+func (c *conn) armReadTimer() {
+	c.readTimer.Stop()
+	c.readTimer = nil
+	if c.readDeadline.IsZero() {
+		return
+	}
+	el := c.loop
+	c.readTimer = el.timer.AfterFunc(time.Until(c.readDeadline), func() error {
+		c.readTimer = nil
+		return el.loopCloseConn(c, errors.ErrReadTimeout)
+	})
+}
+
+// armWriteTimer (re-)arms the timer of write deadline.
+func (c *conn) armWriteTimer() {
+	c.writeTimer.Stop()
+	c.writeTimer = nil
+	if c.writeDeadline.IsZero() {
+		return
+	}
+	el := c.loop
+	c.writeTimer = el.timer.AfterFunc(time.Until(c.writeDeadline), func() error {
+		c.writeTimer = nil
+		if !c.hasPendingOutbound() {
+			return nil
+		}
+		return el.loopCloseConn(c, errors.ErrWriteTimeout)
+	})
+}
+
 func (c *conn) releaseTCP() {
 	c.opened = false
 	c.sa = nil
@@ -64,6 +399,10 @@ func (c *conn) releaseTCP() {
 	c.buffer = nil
 	c.localAddr = nil
 	c.remoteAddr = nil
+	c.replies = nil
+	c.releaseFiles()
+	c.accountOutbound(-c.outboundBuffer.Length())
+	c.accountInbound(0)
 	prb.Put(c.inboundBuffer)
 	prb.Put(c.outboundBuffer)
 	c.inboundBuffer = nil
@@ -72,11 +411,12 @@ func (c *conn) releaseTCP() {
 	c.byteBuffer = nil
 }
 
-func newUDPConn(fd int, el *eventloop, sa unix.Sockaddr) *conn {
+func newUDPConn(fd int, el *eventloop, ln *listener, sa unix.Sockaddr) *conn {
 	return &conn{
 		fd:         fd,
 		sa:         sa,
-		localAddr:  el.ln.lnaddr,
+		loop:       el,
+		localAddr:  ln.lnaddr,
 		remoteAddr: netpoll.SockaddrToUDPAddr(sa),
 	}
 }
@@ -87,54 +427,165 @@ func (c *conn) releaseUDP() {
 	c.remoteAddr = nil
 }
 
-func (c *conn) open(buf []byte) {
+func (c *conn) open(buf []byte) error {
+	// Data written by a client before its connection was established is already queued up, and the poller which
+	// completes the sends sends from the outbound buffer once the connection has been opened.
+	if c.hasPendingOutbound() || c.loop.completer != nil {
+		return c.bufferOutbound(buf)
+	}
+
 	n, err := unix.Write(c.fd, buf)
 	if err != nil {
-		_, _ = c.outboundBuffer.Write(buf)
-		return
+		c.wrote(0, true)
+		return c.bufferOutbound(buf)
 	}
 
+	c.wrote(n, n < len(buf))
 	if n < len(buf) {
-		_, _ = c.outboundBuffer.Write(buf[n:])
+		return c.bufferOutbound(buf[n:])
 	}
+	return nil
 }
 
 func (c *conn) read() ([]byte, error) {
-	return c.codec.Decode(c)
+	buf, err := c.codec.Decode(c)
+	if err != nil && !isIncompleteFrame(err) {
+		atomic.AddUint64(&c.loop.counters.codecErrors, 1)
+	}
+	return buf, err
+}
+
+// encode encodes the data into a frame by codec.
+func (c *conn) encode(buf []byte) ([]byte, error) {
+	out, err := c.codec.Encode(c, buf)
+	if err != nil {
+		atomic.AddUint64(&c.loop.counters.codecErrors, 1)
+	}
+	return out, err
 }
 
 func (c *conn) write(buf []byte) (err error) {
 	var outFrame []byte
-	if outFrame, err = c.codec.Encode(c, buf); err != nil {
+	if outFrame, err = c.encode(buf); err != nil {
 		return
 	}
 	// If there is pending data in outbound buffer, the current data ought to be appended to the outbound buffer
 	// for maintaining the sequence of network packets.
-	if !c.outboundBuffer.IsEmpty() {
-		_, _ = c.outboundBuffer.Write(outFrame)
-		return
+	if c.hasPendingOutbound() {
+		return c.bufferOutbound(outFrame)
+	}
+	if c.loop.completer != nil {
+		if err = c.bufferOutbound(outFrame); err != nil || !c.opened {
+			return
+		}
+		return c.sendOutbound()
 	}
 
 	var n int
 	if n, err = unix.Write(c.fd, outFrame); err != nil {
 		// A temporary error occurs, append the data to outbound buffer, writing it back to client in the next round.
 		if err == unix.EAGAIN {
-			_, _ = c.outboundBuffer.Write(outFrame)
-			err = c.loop.poller.ModReadWrite(c.fd)
+			c.wrote(0, true)
+			if err = c.bufferOutbound(outFrame); err != nil || !c.opened {
+				return
+			}
+			err = c.loop.modReadWrite(c)
 			return
 		}
 		return c.loop.loopCloseConn(c, os.NewSyscallError("write", err))
 	}
+	c.touch()
+	c.wrote(n, n < len(outFrame))
 	// Fail to send all data back to client, buffer the leftover data for the next round.
 	if n < len(outFrame) {
-		_, _ = c.outboundBuffer.Write(outFrame[n:])
-		err = c.loop.poller.ModReadWrite(c.fd)
+		if err = c.bufferOutbound(outFrame[n:]); err != nil || !c.opened {
+			return
+		}
+		err = c.loop.modReadWrite(c)
+	}
+	return
+}
+
+// iovMax is the maximum number of buffers passed to writev(2) at once, aka IOV_MAX.
+const iovMax = 1024
+
+func (c *conn) writev(bs [][]byte) (err error) {
+	outFrames := make([][]byte, 0, len(bs))
+	for _, b := range bs {
+		var outFrame []byte
+		if outFrame, err = c.encode(b); err != nil {
+			return
+		}
+		outFrames = append(outFrames, outFrame)
+	}
+	// If there is pending data in outbound buffer, the current data ought to be appended to the outbound buffer
+	// for maintaining the sequence of network packets.
+	if c.hasPendingOutbound() {
+		_, err = c.bufferLeftover(outFrames, 0)
+		return
+	}
+	if c.loop.completer != nil {
+		var buffered bool
+		if buffered, err = c.bufferLeftover(outFrames, 0); buffered {
+			err = c.sendOutbound()
+		}
+		return
+	}
+
+	iov := outFrames
+	if len(iov) > iovMax {
+		iov = iov[:iovMax]
+	}
+	var n int
+	if n, err = unix.Writev(c.fd, iov); err != nil {
+		// A temporary error occurs, append the data to outbound buffer, writing it back to client in the next round.
+		if err == unix.EAGAIN {
+			c.wrote(0, true)
+			var buffered bool
+			if buffered, err = c.bufferLeftover(outFrames, 0); buffered {
+				err = c.loop.modReadWrite(c)
+			}
+			return
+		}
+		return c.loop.loopCloseConn(c, os.NewSyscallError("writev", err))
+	}
+	c.touch()
+	// Fail to send all data back to client, buffer the leftover data for the next round.
+	size := 0
+	for _, b := range iov {
+		size += len(b)
+	}
+	c.wrote(n, n < size)
+	var buffered bool
+	if buffered, err = c.bufferLeftover(outFrames, n); buffered {
+		err = c.loop.modReadWrite(c)
+	}
+	return
+}
+
+// bufferLeftover appends the bytes of bs after the first n ones to the outbound buffer, it reports whether there is
+// any byte being buffered and the connection is still open.
+func (c *conn) bufferLeftover(bs [][]byte, n int) (buffered bool, err error) {
+	for _, b := range bs {
+		if n >= len(b) {
+			n -= len(b)
+			continue
+		}
+		if err = c.bufferOutbound(b[n:]); err != nil || !c.opened {
+			return false, err
+		}
+		n = 0
+		buffered = true
 	}
 	return
 }
 
 func (c *conn) sendTo(buf []byte) error {
-	return unix.Sendto(c.fd, buf, 0, c.sa)
+	err := unix.Sendto(c.fd, buf, 0, c.sa)
+	if err == nil {
+		c.wrote(len(buf), false)
+	}
+	return err
 }
 
 // ================================= Public APIs of gnet.Conn =================================
@@ -213,27 +664,148 @@ func (c *conn) BufferLength() int {
 }
 
 func (c *conn) AsyncWrite(buf []byte) error {
-	return c.loop.poller.Trigger(func() error {
+	return c.trigger(func(_ *eventloop) (err error) {
 		if c.opened {
 			return c.write(buf)
 		}
+		// Hold the data back until the non-blocking connect completes.
+		if c.connecting {
+			var outFrame []byte
+			if outFrame, err = c.encode(buf); err == nil {
+				err = c.bufferOutbound(outFrame)
+			}
+		}
+		return
+	})
+}
+
+func (c *conn) Writev(bs [][]byte) error {
+	if !c.opened {
+		return nil
+	}
+	return c.writev(bs)
+}
+
+func (c *conn) AsyncWritev(bs [][]byte) error {
+	return c.trigger(func(_ *eventloop) error {
+		if c.opened {
+			return c.writev(bs)
+		}
 		return nil
 	})
 }
 
+func (c *conn) SendFile(f *os.File, offset, length int64) error {
+	if !c.opened {
+		return nil
+	}
+	if length <= 0 {
+		return nil
+	}
+	// Duplicate the file descriptor so that the caller is free to close the file right away.
+	fd, sc, err := netpoll.Dup(int(f.Fd()))
+	if err != nil {
+		return os.NewSyscallError(sc, err)
+	}
+	seg := &fileSegment{fd: fd, offset: offset, remain: length}
+	seg.pre = c.outboundBuffer.Length() - c.filesPre
+	c.filesPre += seg.pre
+	c.files = append(c.files, seg)
+	if c.loop.svr.opts.EdgeTriggered {
+		return c.loop.loopWriteLater(c)
+	}
+	return c.loop.modReadWrite(c)
+}
+
 func (c *conn) SendTo(buf []byte) error {
 	return c.sendTo(buf)
 }
 
 func (c *conn) Wake() error {
-	return c.loop.poller.Trigger(func() error {
-		return c.loop.loopWake(c)
+	return c.trigger(func(el *eventloop) error {
+		return el.loopWake(c)
 	})
 }
 
 func (c *conn) Close() error {
-	return c.loop.poller.Trigger(func() error {
-		return c.loop.loopCloseConn(c, nil)
+	c.taskMu.Lock()
+	after := c.triggered
+	c.taskMu.Unlock()
+	return c.triggerUrgent(func(el *eventloop) error {
+		if c.ranTasks < after {
+			// Let the asynchronous writes triggered before go first.
+			if after > c.closeAfter {
+				c.closeAfter = after
+			}
+			return nil
+		}
+		return el.loopCloseConn(c, nil)
+	})
+}
+
+func (c *conn) MigrateTo(loopIndex int) error {
+	c.taskMu.Lock()
+	svr := c.loop.svr
+	c.taskMu.Unlock()
+	if svr.eventLoopAt(loopIndex) == nil {
+		return errors.ErrInvalidLoopIndex
+	}
+	return c.trigger(func(el *eventloop) error {
+		// The target may have been retired in the meantime.
+		target := el.svr.eventLoopAt(loopIndex)
+		if target == nil || !(c.opened || c.connecting) {
+			return nil
+		}
+		return el.loopMigrate(c, target)
+	})
+}
+
+func (c *conn) PauseRead() error {
+	return c.trigger(func(el *eventloop) error {
+		if !c.opened || c.readPaused {
+			return nil
+		}
+		paused := c.isReadPaused()
+		c.readPaused = true
+		if paused {
+			return nil
+		}
+		return el.watchRead(c)
+	})
+}
+
+func (c *conn) ResumeRead() error {
+	return c.trigger(func(el *eventloop) error {
+		if !c.opened || !c.readPaused {
+			return nil
+		}
+		c.readPaused = false
+		if c.isReadPaused() {
+			return nil
+		}
+		return el.watchRead(c)
+	})
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	return c.trigger(func(_ *eventloop) error {
+		if !c.opened {
+			return nil
+		}
+		c.readDeadline = t
+		c.armReadTimer()
+		return nil
+	})
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return c.trigger(func(_ *eventloop) error {
+		if !c.opened {
+			return nil
+		}
+		c.writeDeadline = t
+		c.armWriteTimer()
+		return nil
 	})
 }
 
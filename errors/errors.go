@@ -21,6 +21,46 @@ var (
 	ErrUnsupportedUDSProtocol = errors.New("only unix is supported")
 	// ErrUnsupportedPlatform occurs when running gnet on an unsupported platform.
 	ErrUnsupportedPlatform = errors.New("unsupported platform in gnet")
+	// ErrIdleTimeout occurs when a connection is closed for being idle longer than the idle timeout.
+	ErrIdleTimeout = errors.New("connection is idle for too long")
+	// ErrReadTimeout occurs when a connection is closed for receiving no data before its read deadline.
+	ErrReadTimeout = errors.New("read deadline exceeded")
+	// ErrWriteTimeout occurs when a connection is closed for failing to flush its data before its write deadline.
+	ErrWriteTimeout = errors.New("write deadline exceeded")
+	// ErrInvalidListenerFd occurs when an inherited file descriptor is not a listening socket of the expected network.
+	ErrInvalidListenerFd = errors.New("fd is not a listening socket of the expected network")
+	// ErrNoListenFds occurs when the fd referred by a listen-fds address is not passed in by LISTEN_FDS.
+	ErrNoListenFds = errors.New("no such fd passed in by LISTEN_FDS for the current process")
+	// ErrRestartFailed occurs when the new process exits before taking over the listeners on hot restart.
+	ErrRestartFailed = errors.New("new process exited before taking over the listeners")
+	// ErrUnsupportedOp occurs when calling an operation that is not supported by the poller in use.
+	ErrUnsupportedOp = errors.New("operation is not supported by the poller")
+	// ErrPollerClosed occurs when triggering a task in a poller which has been closed.
+	ErrPollerClosed = errors.New("poller has been closed")
+	// ErrNoAddress occurs when serving without any address.
+	ErrNoAddress = errors.New("no address to serve on")
+	// ErrInvalidNumEventLoop occurs when scaling event-loops to a non-positive number.
+	ErrInvalidNumEventLoop = errors.New("the number of event-loops must be positive")
+	// ErrInvalidLoopIndex occurs when migrating a connection to an event-loop which doesn't exist.
+	ErrInvalidLoopIndex = errors.New("no event-loop with such an index")
+	// ErrNoEventLoop occurs when the load-balancer has no event-loop to take a new connection.
+	ErrNoEventLoop = errors.New("no event-loop to take the connection")
+	// ErrServerNotStarted occurs when scaling the event-loops of a server which has not started them yet.
+	ErrServerNotStarted = errors.New("event-loops of server have not been started yet")
+	// ErrInboundBufferExceeded occurs when a connection is closed for its inbound buffer growing beyond
+	// the limit set by WithMaxInboundBuffer.
+	ErrInboundBufferExceeded = errors.New("inbound buffer exceeds its limit")
+	// ErrOutboundBufferExceeded occurs when a connection is closed for its outbound buffer growing beyond
+	// the limit set by WithMaxOutboundBuffer.
+	ErrOutboundBufferExceeded = errors.New("outbound buffer exceeds its limit")
+	// ErrMemoryBudgetExceeded occurs when a connection is closed for growing the buffers of all connections
+	// beyond the budget set by WithMemoryBudget.
+	ErrMemoryBudgetExceeded = errors.New("buffers of connections exceed the memory budget")
+	// ErrWorkerPoolOverload occurs when offloading a frame to the worker pool which has no idle worker.
+	ErrWorkerPoolOverload = errors.New("worker pool is overloaded")
+	// ErrAsyncTaskQueueFull occurs when triggering an asynchronous task, e.g. by AsyncWrite or Wake, while the queue
+	// of the event-loop is holding as many tasks as the capacity set by WithAsyncTaskQueueCapacity.
+	ErrAsyncTaskQueueFull = errors.New("asynchronous task queue of event-loop is full")
 
 	// ================================================= codec errors =================================================
 
@@ -36,4 +76,6 @@ var (
 	ErrUnsupportedLength = errors.New("unsupported lengthFieldLength. (expected: 1, 2, 3, 4, or 8)")
 	// ErrTooLessLength occurs when adjusted frame length is less than zero.
 	ErrTooLessLength = errors.New("adjusted frame length is less than zero")
+	// ErrFrameTooLarge occurs when the length of frame exceeds the maximum length or can't be represented by int.
+	ErrFrameTooLarge = errors.New("frame length exceeds the maximum")
 )
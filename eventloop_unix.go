@@ -5,14 +5,31 @@ package shpnetpoll
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
-	"runtime"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
 	gerrors "shpnetpoll/errors"
 	"shpnetpoll/internal/netpoll"
+	"shpnetpoll/internal/timingwheel"
+)
+
+const (
+	// edgeTriggeredReadBudget is the maximum number of reads on a connection per readable event in edge-triggered
+	// mode, the rest of data will be read in an asynchronous task after the other ready connections.
+	edgeTriggeredReadBudget = 16
+
+	// timerTick is the precision of connection timeouts.
+	timerTick = 100 * time.Millisecond
+	// timerSlots is the number of slots in the timing wheel of event-loop.
+	timerSlots = 512
+
+	// retireGracePeriod is how long a retired event-loop keeps running after it has migrated all its connections,
+	// to forward the tasks triggered for them before the migration to their new event-loops.
+	retireGracePeriod = time.Second
 )
 
 type eventloop struct {
@@ -24,15 +41,230 @@ type eventloop struct {
 }
 
 type internalEventloop struct {
-	ln                *listener               // listener
-	idx               int                     // loop index in the server loops list
-	svr               *server                 // server in loop
-	poller            *netpoll.Poller         // epoll or kqueue
-	packet            []byte                  // read packet buffer whose capacity is 64KB
-	connCount         int32                   // number of active connections in event-loop
-	connections       map[int]*conn           // loop connections fd -> conn
-	eventHandler      EventHandler            // user eventHandler
-	calibrateCallback func(*eventloop, int32) // callback func for re-adjusting connCount
+	outboundBytes     int64                    // bytes pending in outbound buffers, kept first for 64-bit alignment
+	inboundBytes      int64                    // bytes buffered in inbound buffers, kept next to outboundBytes for 64-bit alignment
+	counters          loopStats                // counters of metrics, kept next to outboundBytes for 64-bit alignment
+	listeners         map[int]*listener        // listeners watched by the event-loop, fd -> listener
+	idx               int                      // loop index in the server loops list
+	svr               *server                  // server in loop
+	poller            netpoll.Poller           // epoll or kqueue
+	completer         netpoll.Completer        // poller if it completes accepts, receives and sends, nil otherwise
+	packet            []byte                   // read packet buffer whose capacity is 64KB
+	connCount         int32                    // number of active connections in event-loop
+	connections       map[int]*conn            // loop connections fd -> conn
+	eventHandler      EventHandler             // user eventHandler
+	calibrateCallback func(*eventloop, int32)  // callback func for re-adjusting connCount
+	timer             *timingwheel.TimingWheel // timers of connection timeouts and deadlines
+	draining          bool                     // whether the event-loop is draining connections for shutdown
+	retired           bool                     // whether the event-loop has been retired by Server.ScaleEventLoops
+	forwarded         int                      // number of tasks forwarded to the new event-loops of connections
+	observer          *loopObserver            // latency histograms and slow callbacks, nil if neither is enabled
+	exited            chan struct{}            // closed once the event-loop has exited
+}
+
+func newEventLoop(svr *server, p netpoll.Poller) *eventloop {
+	el := new(eventloop)
+	el.listeners = make(map[int]*listener)
+	el.svr = svr
+	el.poller = p
+	el.completer, _ = p.(netpoll.Completer)
+	el.packet = make([]byte, svr.opts.ReadBufferCap)
+	el.connections = make(map[int]*conn)
+	el.eventHandler = svr.eventHandler
+	el.calibrateCallback = svr.lb.calibrate
+	el.timer = timingwheel.New(timerTick, timerSlots)
+	el.exited = make(chan struct{})
+	el.poller.SetTimer(el.timer)
+	if el.observer = newLoopObserver(el); el.observer != nil {
+		el.poller.SetObserver(el.observer)
+	}
+	return el
+}
+
+// Index returns the index of event-loop, which is assigned in the order of registration starting from 0.
+func (el *eventloop) Index() int {
+	return el.idx
+}
+
+// ConnCount returns the number of active connections in event-loop.
+func (el *eventloop) ConnCount() int32 {
+	return atomic.LoadInt32(&el.connCount)
+}
+
+// OutboundBytes returns the number of bytes pending in the outbound buffers of connections in event-loop.
+func (el *eventloop) OutboundBytes() int64 {
+	return atomic.LoadInt64(&el.outboundBytes)
+}
+
+// InboundBytes returns the number of bytes buffered in the inbound buffers of connections in event-loop.
+func (el *eventloop) InboundBytes() int64 {
+	return atomic.LoadInt64(&el.inboundBytes)
+}
+
+// PendingTasks returns the number of asynchronous tasks waiting to be run by event-loop.
+func (el *eventloop) PendingTasks() int {
+	return el.poller.PendingTasks()
+}
+
+// Latency returns the smoothed duration that event-loop spent on handling the events of its recent iterations.
+func (el *eventloop) Latency() time.Duration {
+	return el.poller.Latency()
+}
+
+// addListener starts watching the listener for new connections or datagrams.
+func (el *eventloop) addListener(ln *listener) error {
+	el.listeners[ln.fd] = ln
+	if el.completer != nil && ln.network != "udp" {
+		return el.completer.AddAcceptor(ln.fd)
+	}
+	return el.poller.AddRead(ln.fd)
+}
+
+// addConn registers a new connection to the poller, with writable event as well if write is true.
+func (el *eventloop) addConn(fd int, write bool) error {
+	switch {
+	case el.svr.opts.EdgeTriggered:
+		return el.poller.AddReadWriteET(fd)
+	case el.completer != nil:
+		return el.completer.AddStream(fd, write)
+	case write:
+		return el.poller.AddReadWrite(fd)
+	}
+	return el.poller.AddRead(fd)
+}
+
+// accept4 takes a connection from the listener, which has been accepted by the poller if it completes the accepts.
+func (el *eventloop) accept4(fd int) (int, unix.Sockaddr, error) {
+	if el.completer != nil {
+		return el.completer.Accepted(fd)
+	}
+	// Accept with close-on-exec to keep connections from leaking into the processes started by hot restart.
+	return unix.Accept4(fd, unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+}
+
+// read reads from the connection into the packet buffer, or takes the data received by the poller if it completes
+// the receives. An empty result without error is the end of stream.
+func (el *eventloop) read(c *conn) ([]byte, error) {
+	if el.completer != nil {
+		return el.completer.Recv(c.fd, el.packet)
+	}
+	n, err := unix.Read(c.fd, el.packet)
+	if n < 0 {
+		n = 0
+	}
+	return el.packet[:n], err
+}
+
+// detach removes the connection being migrated from the poller. The bytes sent by the poller which completes
+// the sends are dropped from the outbound buffer, and the data received by it are left in the inbound buffer
+// for the event-loop adopting the connection to react to.
+func (el *eventloop) detach(c *conn) error {
+	if el.completer == nil {
+		return el.poller.Delete(c.fd)
+	}
+	received, sent, err := el.completer.Detach(c.fd)
+	if err != nil {
+		return err
+	}
+	if sent > 0 {
+		c.outboundBuffer.Shift(sent)
+		if len(c.files) > 0 {
+			c.files[0].pre -= sent
+			c.filesPre -= sent
+		}
+		atomic.AddInt64(&el.outboundBytes, -int64(sent))
+		atomic.AddInt64(&el.svr.bufferedBytes, -int64(sent))
+		atomic.AddUint64(&el.counters.bytesWritten, uint64(sent))
+	}
+	if len(received) > 0 {
+		_, _ = c.inboundBuffer.Write(received)
+		c.reactPending = true
+		atomic.AddUint64(&el.counters.bytesRead, uint64(len(received)))
+	}
+	return nil
+}
+
+// modRead stops monitoring the writable events of connection, it's a no-op in edge-triggered mode.
+// The readable events are not monitored either while reading from the connection is paused.
+func (el *eventloop) modRead(c *conn) error {
+	if el.svr.opts.EdgeTriggered {
+		return nil
+	}
+	if c.isReadPaused() {
+		return el.poller.ModNone(c.fd)
+	}
+	return el.poller.ModRead(c.fd)
+}
+
+// modReadWrite starts monitoring the writable events of connection, it's a no-op in edge-triggered mode.
+// The readable events are not monitored while reading from the connection is paused.
+func (el *eventloop) modReadWrite(c *conn) error {
+	if el.svr.opts.EdgeTriggered {
+		return nil
+	}
+	if c.isReadPaused() {
+		return el.poller.ModWrite(c.fd)
+	}
+	return el.poller.ModReadWrite(c.fd)
+}
+
+// watchRead applies the pause of reading from connection to the poller after it's changed. An edge-triggered poller
+// keeps reporting the readable events, which are ignored while it's paused, so the connection is read in a task
+// once it's resumed since the data that have arrived in the meantime won't be reported again.
+func (el *eventloop) watchRead(c *conn) error {
+	if c.reactPending && !c.isReadPaused() {
+		// React to the frames left in buffers by the in-flight limit of offloads before the data read afterwards,
+		// in a task since the connection may be in the middle of writing.
+		_ = c.triggerUrgent(func(loop *eventloop) error {
+			return loop.loopReactPending(c)
+		})
+	}
+	if el.svr.opts.EdgeTriggered {
+		if c.isReadPaused() {
+			return nil
+		}
+		return el.loopReadLater(c)
+	}
+	if c.hasPendingOutbound() {
+		return el.modReadWrite(c)
+	}
+	return el.modRead(c)
+}
+
+// loopRunTask runs the task triggered for the connection in the normal lane, and closes the connection afterwards
+// if Close is waiting for it.
+func (el *eventloop) loopRunTask(c *conn, task connTask) error {
+	err := task(el)
+	c.ranTasks++
+	if c.closeAfter == 0 || c.ranTasks < c.closeAfter || err == gerrors.ErrServerShutdown {
+		return err
+	}
+	c.closeAfter = 0
+	sniffErrorAndLog(err)
+	return el.loopCloseConn(c, nil)
+}
+
+// loopReadLater reads from the connection in an asynchronous task, unless it's closed or paused by then.
+// Like the other continuations of event-loop, the task goes in the high-priority lane which never rejects it,
+// otherwise no further edge would report the data left in socket.
+func (el *eventloop) loopReadLater(c *conn) error {
+	return c.triggerUrgent(func(loop *eventloop) error {
+		if c.opened && !c.isReadPaused() {
+			return loop.loopRead(c)
+		}
+		return nil
+	})
+}
+
+// loopWriteLater flushes the outbound data of connection in an asynchronous task, which is needed in edge-triggered
+// mode when a writable socket has data to send but won't report another writable event.
+func (el *eventloop) loopWriteLater(c *conn) error {
+	return c.triggerUrgent(func(loop *eventloop) error {
+		if c.opened {
+			return loop.loopWrite(c)
+		}
+		return nil
+	})
 }
 
 func (el *eventloop) closeAllConns() {
@@ -43,99 +275,185 @@ func (el *eventloop) closeAllConns() {
 }
 
 func (el *eventloop) loopRun(lockOSThread bool) {
-	if lockOSThread {
-		runtime.LockOSThread()
-		defer runtime.UnlockOSThread()
-	}
+	defer close(el.exited)
+	defer el.lockOSThread(lockOSThread)()
 
 	defer func() {
 		el.closeAllConns()
-		el.ln.close()
+		for _, ln := range el.listeners {
+			ln.close()
+		}
+		if el.retired {
+			// A retired event-loop exits alone without shutting down the server.
+			sniffErrorAndLog(el.poller.Close())
+			el.svr.retireStats(el)
+			return
+		}
 		el.svr.signalShutdown()
 	}()
 
+	if el.observer != nil {
+		el.observer.bind()
+	}
 	err := el.poller.Polling(el.handleEvent)
 	el.svr.logger.Infof("Event-loop(%d) is exiting due to error: %v", el.idx, err)
 }
 
 func (el *eventloop) loopAccept(fd int) error {
-	if fd == el.ln.fd {
-		if el.ln.network == "udp" {
-			return el.loopReadUDP(fd)
+	if ln, ok := el.listeners[fd]; ok {
+		if ln.network == "udp" {
+			return el.loopReadUDP(ln)
 		}
+		_, err := el.accept(ln)
+		return err
+	}
 
-		nfd, sa, err := unix.Accept(fd)
-		if err != nil {
-			if err == unix.EAGAIN {
-				return nil
-			}
-			return os.NewSyscallError("accept", err)
-		}
-		if err = os.NewSyscallError("fcntl nonblock", unix.SetNonblock(nfd, true)); err != nil {
-			return err
-		}
+	return nil
+}
 
-		netAddr := netpoll.SockaddrToTCPOrUnixAddr(sa)
-		c := newTCPConn(nfd, el, sa, netAddr)
-		if err = el.poller.AddRead(c.fd); err == nil {
-			el.connections[c.fd] = c
-			return el.loopOpen(c)
+// accept accepts a connection from the listener and opens it, it reports false if there is no pending connection.
+func (el *eventloop) accept(ln *listener) (bool, error) {
+	nfd, sa, err := el.accept4(ln.fd)
+	if err != nil {
+		if err == unix.EAGAIN {
+			return false, nil
 		}
-		return err
+		return false, os.NewSyscallError("accept", err)
 	}
 
-	return nil
+	netAddr := netpoll.SockaddrToTCPOrUnixAddr(sa)
+	c := newTCPConn(nfd, el, ln, sa, netAddr)
+	if err = el.addConn(c.fd, false); err == nil {
+		el.connections[c.fd] = c
+		return true, el.loopOpen(c)
+	}
+	return true, err
+}
+
+// loopRegister starts serving the connection accepted by the main reactor or dialed by client,
+// the connection is migrated to another event-loop right away if this one has been retired.
+func (el *eventloop) loopRegister(c *conn) (err error) {
+	if err = el.addConn(c.fd, c.connecting); err != nil {
+		if c.connecting {
+			// Dial has handed the connection out, report the failure through OnClosed like a failed connect.
+			return el.loopConnectFailed(c, os.NewSyscallError("add", err))
+		}
+		_ = unix.Close(c.fd)
+		c.releaseTCP()
+		return
+	}
+	el.connections[c.fd] = c
+	if !c.connecting {
+		if err = el.loopOpen(c); err != nil || !c.opened {
+			return
+		}
+	}
+	if el.retired {
+		return el.loopMigrate(c, el.svr.lb.next(c.remoteAddr))
+	}
+	return
 }
 
 func (el *eventloop) loopOpen(c *conn) error {
 	c.opened = true
+	if idleTimeout := el.svr.opts.IdleTimeout; idleTimeout > 0 {
+		c.lastActive = time.Now()
+		c.idleTimer = el.timer.AfterFunc(idleTimeout, func() error {
+			return el.loopIdleTimeout(c)
+		})
+	}
 	// 负载均衡对象进行索引的计算
 	el.calibrateCallback(el, 1)
+	atomic.AddUint64(&el.counters.accepted, 1)
 
 	// TODO 这是一个钩子函数，本来的实现不会返回任何数据，触发时机是当连接建立时。
 	out, action := el.eventHandler.OnOpened(c)
 	if out != nil {
-		c.open(out)
+		if err := c.open(out); err != nil || !c.opened {
+			return err
+		}
 	}
 
 	// TODO 这里的outbounduffer是只会在上面的钩子函数中改写，还是所有的goroutine都可能会改写
-	if !c.outboundBuffer.IsEmpty() {
-		_ = el.poller.AddWrite(c.fd)
+	if c.hasPendingOutbound() {
+		if el.svr.opts.EdgeTriggered {
+			_ = el.loopWriteLater(c)
+		} else {
+			_ = el.modReadWrite(c)
+		}
 	}
 
 	// 处理上面钩子函数返回的action
-	return el.handleAction(c, action)
+	if err := el.handleAction(c, action); err != nil || !c.opened || !el.draining {
+		return err
+	}
+	return el.loopDrainConn(c)
 }
 
 func (el *eventloop) loopRead(c *conn) error {
-	// 判断是否有可读数据
-	n, err := unix.Read(c.fd, el.packet)
-	if n == 0 || err != nil {
-		if err == unix.EAGAIN {
+	for i := 0; ; i++ {
+		// 判断是否有可读数据
+		data, err := el.read(c)
+		if len(data) == 0 || err != nil {
+			if err == unix.EAGAIN {
+				return nil
+			}
+			return el.loopCloseConn(c, os.NewSyscallError("read", err))
+		}
+		atomic.AddUint64(&el.counters.bytesRead, uint64(len(data)))
+		c.buffer = data
+		c.touch()
+		if c.readTimer != nil {
+			c.readTimer.Stop()
+			c.readTimer = nil
+			c.readDeadline = time.Time{}
+		}
+
+		// 反复进行数据读入
+		if err = el.loopReact(c); err != nil || !c.opened {
+			return err
+		}
+		_, _ = c.inboundBuffer.Write(c.buffer)
+		grown := c.accountInbound(c.inboundBuffer.Length())
+		if err = c.checkInbound(grown); err != nil {
+			return el.loopCloseConn(c, err)
+		}
+
+		// A level-triggered poller will report the data left in socket on the next round, but an edge-triggered one
+		// won't, so keep reading until EAGAIN or EOF. A short read doesn't mean that there is nothing left, the FIN
+		// that arrives along with the data is only seen by the read returning 0, and no further edge is reported.
+		// The data left are read once reading is resumed if it has been paused in the meantime.
+		if !el.svr.opts.EdgeTriggered || c.isReadPaused() {
 			return nil
 		}
-		return el.loopCloseConn(c, os.NewSyscallError("read", err))
+		if i == edgeTriggeredReadBudget-1 {
+			// Run out of the budget, let the other connections go first.
+			return el.loopReadLater(c)
+		}
 	}
-	c.buffer = el.packet[:n]
+}
 
-	// 反复进行数据读入
-	for inFrame, _ := c.read(); inFrame != nil; inFrame, _ = c.read() {
-		out, action := el.eventHandler.React(inFrame, c)
-		if out != nil {
-			el.eventHandler.PreWrite()
-			// Encode data and try to write it back to the client, this attempt is based on a fact:
-			// a client socket waits for the response data after sending request data to the server,
-			// which makes the client socket writable.
-			if err = c.write(out); err != nil {
-				return err
+// loopReact decodes the frames in the buffers of connection and fires React on them, it stops once the connection has
+// as many offloaded frames in flight as allowed, leaving the rest of frames in the buffers.
+func (el *eventloop) loopReact(c *conn) error {
+	c.reactPending = false
+	for {
+		if c.offloadsFull() {
+			c.reactPending = true
+			return nil
+		}
+		inFrame, err := c.read()
+		if inFrame == nil {
+			// A frame announced to be too large would be buffered until the limits of buffers are exceeded.
+			if err == gerrors.ErrFrameTooLarge {
+				return el.loopCloseConn(c, err)
 			}
+			return nil
 		}
-		switch action {
-		case None:
-		case Close:
-			return el.loopCloseConn(c, nil)
-		case Shutdown:
-			return gerrors.ErrServerShutdown
+		atomic.AddUint64(&el.counters.reacts, 1)
+		out, action := el.eventHandler.React(inFrame, c)
+		if err = el.loopReply(c, out, action); err != nil {
+			return err
 		}
 
 		// Check the status of connection every loop since it might be closed during writing data back to client due to
@@ -144,65 +462,107 @@ func (el *eventloop) loopRead(c *conn) error {
 			return nil
 		}
 	}
-	_, _ = c.inboundBuffer.Write(c.buffer)
-
-	return nil
 }
 
 func (el *eventloop) loopWrite(c *conn) error {
 	el.eventHandler.PreWrite()
 
-	head, tail := c.outboundBuffer.LazyReadAll()
-	n, err := unix.Write(c.fd, head)
-	if err != nil {
-		if err == unix.EAGAIN {
+	// Send the queued files in order, each one after the bytes of outbound buffer preceding it.
+	for len(c.files) > 0 {
+		seg := c.files[0]
+		if seg.pre > 0 {
+			n, err := c.flushOutbound(seg.pre)
+			if err != nil {
+				if err == unix.EAGAIN {
+					return nil
+				}
+				return el.loopCloseConn(c, os.NewSyscallError("write", err))
+			}
+			seg.pre -= n
+			c.filesPre -= n
+			if seg.pre > 0 {
+				return nil
+			}
+		}
+
+		size := seg.remain
+		if size > maxSendfileSize {
+			size = maxSendfileSize
+		}
+		n, err := unix.Sendfile(c.fd, seg.fd, &seg.offset, int(size))
+		if err != nil {
+			if err == unix.EAGAIN {
+				return nil
+			}
+			return el.loopCloseConn(c, os.NewSyscallError("sendfile", err))
+		}
+		if n == 0 {
+			// The file is shorter than expected, the peer would wait for the missing bytes forever.
+			return el.loopCloseConn(c, io.ErrUnexpectedEOF)
+		}
+		atomic.AddUint64(&el.counters.bytesWritten, uint64(n))
+		c.touch()
+		if seg.remain -= int64(n); seg.remain > 0 {
+			// The socket is still writable after a full chunk, it won't be reported again in edge-triggered mode.
+			if el.svr.opts.EdgeTriggered && n == int(size) {
+				return el.loopWriteLater(c)
+			}
 			return nil
 		}
-		return el.loopCloseConn(c, os.NewSyscallError("write", err))
+		_ = unix.Close(seg.fd)
+		c.files[0] = nil
+		c.files = c.files[1:]
 	}
-	c.outboundBuffer.Shift(n)
 
-	if n == len(head) && tail != nil {
-		n, err = unix.Write(c.fd, tail)
-		if err != nil {
+	if !c.outboundBuffer.IsEmpty() {
+		if _, err := c.flushOutbound(c.outboundBuffer.Length()); err != nil {
 			if err == unix.EAGAIN {
 				return nil
 			}
 			return el.loopCloseConn(c, os.NewSyscallError("write", err))
 		}
-		c.outboundBuffer.Shift(n)
 	}
 
 	// All data have been drained, it's no need to monitor the writable events,
 	// remove the writable event from poller to help the future event-loops.
-	if c.outboundBuffer.IsEmpty() {
-		_ = el.poller.ModRead(c.fd)
+	if !c.hasPendingOutbound() {
+		if c.closing {
+			return el.loopCloseConn(c, nil)
+		}
+		_ = el.modRead(c)
 	}
 
 	return nil
 }
 
 func (el *eventloop) loopCloseConn(c *conn, err error) (rerr error) {
+	if c.connecting {
+		return el.loopConnectFailed(c, err)
+	}
 	if !c.opened {
 		//return fmt.Errorf("the fd=%d in event-loop(%d) is already closed, skipping it", c.fd, el.idx)
 		return nil
 	}
+	c.stopTimers()
 
-	// Send residual data in buffer back to client before actually closing the connection.
+	// Send residual data in buffer back to client before actually closing the connection,
+	// the data queued after a file that has not been sent yet are dropped.
 	if !c.outboundBuffer.IsEmpty() {
 		el.eventHandler.PreWrite()
 
-		head, tail := c.outboundBuffer.LazyReadAll()
-		if n, err := unix.Write(c.fd, head); err == nil {
-			if n == len(head) && tail != nil {
-				_, _ = unix.Write(c.fd, tail)
-			}
+		n := c.outboundBuffer.Length()
+		if len(c.files) > 0 {
+			n = c.files[0].pre
+		}
+		if n > 0 {
+			_, _ = c.flushOutbound(n)
 		}
 	}
 
 	if err0, err1 := el.poller.Delete(c.fd), unix.Close(c.fd); err0 == nil && err1 == nil {
 		delete(el.connections, c.fd)
 		el.calibrateCallback(el, -1)
+		atomic.AddUint64(&el.counters.closed, 1)
 		if el.eventHandler.OnClosed(c, err) == Shutdown {
 			return gerrors.ErrServerShutdown
 		}
@@ -224,18 +584,275 @@ func (el *eventloop) loopCloseConn(c *conn, err error) (rerr error) {
 	return
 }
 
+// loopIdleTimeout closes the connection if it has been idle for the idle timeout,
+// otherwise it re-arms the timer for the rest of timeout.
+func (el *eventloop) loopIdleTimeout(c *conn) error {
+	idleTimeout := el.svr.opts.IdleTimeout
+	if idle := time.Since(c.lastActive); idle < idleTimeout {
+		c.idleTimer = el.timer.AfterFunc(idleTimeout-idle, func() error {
+			return el.loopIdleTimeout(c)
+		})
+		return nil
+	}
+	c.idleTimer = nil
+	return el.loopCloseConn(c, gerrors.ErrIdleTimeout)
+}
+
+// loopCloseOnAction closes the connection on the Close action, while the event-loop is draining,
+// it waits for the outbound data to be flushed first.
+func (el *eventloop) loopCloseOnAction(c *conn) error {
+	if el.draining && c.hasPendingOutbound() {
+		c.closing = true
+		return nil
+	}
+	return el.loopCloseConn(c, nil)
+}
+
+// loopDrain stops accepting new connections in the event-loop and fires OnDraining on all its connections.
+func (el *eventloop) loopDrain() error {
+	el.draining = true
+	for fd := range el.listeners {
+		_ = el.poller.Delete(fd)
+	}
+	for _, c := range el.connections {
+		if !c.opened {
+			continue
+		}
+		if err := el.loopDrainConn(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (el *eventloop) loopDrainConn(c *conn) error {
+	// Serve the requests that have already arrived first, closing a socket with unread data resets the connection.
+	if !c.isReadPaused() {
+		if err := el.loopRead(c); err != nil || !c.opened {
+			return err
+		}
+	}
+	action := Close
+	if h, ok := el.eventHandler.(drainer); ok {
+		action = h.OnDraining(c)
+	}
+	switch action {
+	case Close:
+		return el.loopCloseOnAction(c)
+	case Shutdown:
+		return gerrors.ErrServerShutdown
+	}
+	return nil
+}
+
+// loopMigrate hands the connection over to the target event-loop with its buffers, timers and the state of
+// connecting. The tasks triggered for it from now on wait for the target event-loop to adopt it, behind the ones
+// triggered in this event-loop before, which are forwarded once they are dequeued.
+func (el *eventloop) loopMigrate(c *conn, target *eventloop) error {
+	if target == nil {
+		return gerrors.ErrNoEventLoop
+	}
+	if target == el {
+		return nil
+	}
+	// Queue the hand-over up first so that the migration fails without side effects if the queue is full.
+	// It runs behind the tasks already queued in this event-loop, the urgent ones always run ahead of it.
+	c.taskMu.Lock()
+	err := el.poller.Trigger(func() error {
+		c.taskMu.Lock()
+		calledOff := c.loop != target || !c.migrating
+		c.taskMu.Unlock()
+		if calledOff {
+			return nil
+		}
+		if err := target.poller.UrgentTrigger(func() error { return target.loopAdopt(c) }); err != nil {
+			return target.loopDropConn(c, err)
+		}
+		return nil
+	})
+	if err != nil {
+		c.taskMu.Unlock()
+		return err
+	}
+	c.loop = target
+	c.migrating = true
+	c.taskMu.Unlock()
+
+	if err = el.detach(c); err != nil {
+		// The tasks triggered in the meantime are dropped along with the connection.
+		c.taskMu.Lock()
+		c.loop, c.migrating = el, false
+		c.tasks, c.staleTasks = nil, 0
+		c.taskMu.Unlock()
+		return el.loopCloseConn(c, err)
+	}
+	delete(el.connections, c.fd)
+	c.stopTimers()
+
+	// Move the load to the target first so that it's never missing from the event-loops in the meantime.
+	if c.opened {
+		target.calibrateCallback(target, 1)
+		el.calibrateCallback(el, -1)
+	}
+	n := int64(c.outboundBuffer.Length())
+	target.counters.observeOutbound(atomic.AddInt64(&target.outboundBytes, n))
+	atomic.AddInt64(&el.outboundBytes, -n)
+	atomic.AddInt64(&target.inboundBytes, int64(c.inboundBytes))
+	atomic.AddInt64(&el.inboundBytes, -int64(c.inboundBytes))
+	atomic.AddInt64(&target.counters.inflightOffloads, int64(c.inflight))
+	atomic.AddInt64(&el.counters.inflightOffloads, -int64(c.inflight))
+	return nil
+}
+
+// loopAdopt starts serving the connection migrated from another event-loop.
+func (el *eventloop) loopAdopt(c *conn) (err error) {
+	if err = el.addConn(c.fd, c.connecting || c.hasPendingOutbound()); err != nil {
+		return el.loopDropConn(c, os.NewSyscallError("add", err))
+	}
+	// React to the data received by the previous event-loop as well.
+	if c.isReadPaused() || c.reactPending {
+		_ = el.watchRead(c)
+	}
+	el.connections[c.fd] = c
+	if c.opened {
+		c.resumeTimers()
+	}
+	if err = el.loopPendingTasks(c); err != nil || c.loop != el {
+		return
+	}
+	if el.retired && (c.opened || c.connecting) {
+		return el.loopMigrate(c, el.svr.lb.next(c.remoteAddr))
+	}
+	return nil
+}
+
+// loopPendingTasks runs the tasks triggered during the migration of connection in order, until the connection is
+// migrated again by one of them.
+func (el *eventloop) loopPendingTasks(c *conn) error {
+	for {
+		c.taskMu.Lock()
+		tasks := c.tasks
+		if c.loop != el || len(tasks) == 0 {
+			c.migrating = c.loop != el
+			c.taskMu.Unlock()
+			return nil
+		}
+		c.tasks, c.staleTasks = nil, 0
+		c.taskMu.Unlock()
+
+		for i, task := range tasks {
+			if c.loop != el {
+				// The rest follow the connection ahead of the tasks triggered since it's migrated again.
+				c.taskMu.Lock()
+				c.tasks = append(tasks[i:len(tasks):len(tasks)], c.tasks...)
+				c.staleTasks += len(tasks) - i
+				c.taskMu.Unlock()
+				return nil
+			}
+			err := task(el)
+			if err == gerrors.ErrServerShutdown {
+				return err
+			}
+			sniffErrorAndLog(err)
+		}
+	}
+}
+
+// loopDropConn closes the connection which failed to be migrated to the event-loop.
+func (el *eventloop) loopDropConn(c *conn, err error) error {
+	c.taskMu.Lock()
+	c.migrating = false
+	c.tasks, c.staleTasks = nil, 0
+	c.taskMu.Unlock()
+	_ = unix.Close(c.fd)
+	if c.connecting {
+		c.connecting = false
+	} else {
+		el.calibrateCallback(el, -1)
+		atomic.AddUint64(&el.counters.closed, 1)
+	}
+	action := el.eventHandler.OnClosed(c, err)
+	c.releaseTCP()
+	if action == Shutdown {
+		return gerrors.ErrServerShutdown
+	}
+	return nil
+}
+
+// loopShed migrates the connections of event-loop to the targets, one connection for each of them.
+func (el *eventloop) loopShed(targets []*eventloop) error {
+	if el.retired {
+		return nil
+	}
+	for _, c := range el.connections {
+		if len(targets) == 0 {
+			break
+		}
+		if !c.opened {
+			continue
+		}
+		sniffErrorAndLog(el.loopMigrate(c, targets[0]))
+		targets = targets[1:]
+	}
+	return nil
+}
+
+// loopRetire stops the event-loop from taking new connections and migrates all its connections to the other
+// event-loops chosen by load-balancer, which must have unregistered the event-loop. The event-loop keeps running
+// for retireGracePeriod after that to forward the tasks triggered before the migration, and then exits.
+func (el *eventloop) loopRetire() error {
+	el.retired = true
+	for fd, ln := range el.listeners {
+		_ = el.poller.Delete(fd)
+		delete(el.listeners, fd)
+		if el.svr.sharesListener(ln) {
+			continue
+		}
+		// Closing a listener bound in ReusePort mode resets the connections in its accept queue, take them first.
+		if ln.network != "udp" {
+			for {
+				if ok, err := el.accept(ln); !ok || err != nil {
+					break
+				}
+			}
+		}
+		ln.close()
+	}
+
+	for _, c := range el.connections {
+		sniffErrorAndLog(el.loopMigrate(c, el.svr.lb.next(c.remoteAddr)))
+	}
+	el.armRetireTimer()
+	return nil
+}
+
+// armRetireTimer arms the timer to shut the retired event-loop down if no task is forwarded in the grace period.
+func (el *eventloop) armRetireTimer() {
+	forwarded := el.forwarded
+	el.timer.AfterFunc(retireGracePeriod, func() error {
+		if el.forwarded == forwarded && el.poller.PendingTasks() == 0 && len(el.connections) == 0 {
+			return gerrors.ErrServerShutdown
+		}
+		// Retry the connections which failed to be migrated, e.g. for the task queue being full.
+		for _, c := range el.connections {
+			sniffErrorAndLog(el.loopMigrate(c, el.svr.lb.next(c.remoteAddr)))
+		}
+		el.armRetireTimer()
+		return nil
+	})
+}
+
 func (el *eventloop) loopWake(c *conn) error {
 	//if co, ok := el.connections[c.fd]; !ok || co != c {
 	//	return nil // ignore stale wakes.
 	//}
+	atomic.AddUint64(&el.counters.reacts, 1)
 	out, action := el.eventHandler.React(nil, c)
-	if out != nil {
-		if err := c.write(out); err != nil {
-			return err
-		}
+	if c.opened {
+		c.accountInbound(c.inboundBuffer.Length())
 	}
-
-	return el.handleAction(c, action)
+	// The reply goes out after those of the frames offloaded before the wake.
+	return el.loopReply(c, out, action)
 }
 
 func (el *eventloop) loopTicker() {
@@ -245,7 +862,7 @@ func (el *eventloop) loopTicker() {
 		err   error
 	)
 	for {
-		err = el.poller.Trigger(func() (err error) {
+		err = el.poller.UrgentTrigger(func() (err error) {
 			delay, action := el.eventHandler.Tick()
 			el.svr.ticktock <- delay
 			switch action {
@@ -272,7 +889,7 @@ func (el *eventloop) handleAction(c *conn, action Action) error {
 	case None:
 		return nil
 	case Close:
-		return el.loopCloseConn(c, nil)
+		return el.loopCloseOnAction(c)
 	case Shutdown:
 		return gerrors.ErrServerShutdown
 	default:
@@ -280,7 +897,8 @@ func (el *eventloop) handleAction(c *conn, action Action) error {
 	}
 }
 
-func (el *eventloop) loopReadUDP(fd int) error {
+func (el *eventloop) loopReadUDP(ln *listener) error {
+	fd := ln.fd
 	n, sa, err := unix.Recvfrom(fd, el.packet, 0)
 	if err != nil {
 		if err == unix.EAGAIN || err == unix.EWOULDBLOCK {
@@ -290,7 +908,9 @@ func (el *eventloop) loopReadUDP(fd int) error {
 			fd, el.idx, os.NewSyscallError("recvfrom", err))
 	}
 
-	c := newUDPConn(fd, el, sa)
+	atomic.AddUint64(&el.counters.bytesRead, uint64(n))
+	c := newUDPConn(fd, el, ln, sa)
+	atomic.AddUint64(&el.counters.reacts, 1)
 	out, action := el.eventHandler.React(el.packet[:n], c)
 	if out != nil {
 		el.eventHandler.PreWrite()
@@ -3,9 +3,10 @@ package shpnetpoll
 import (
 	"context"
 	"net"
+	"net/http"
+	"os"
 	"runtime"
 	"strings"
-	"sync/atomic"
 	"time"
 
 	"shpnetpoll/errors"
@@ -42,6 +43,10 @@ type Server struct {
 	// with the addr string passed to the Serve function.
 	Addr net.Addr
 
+	// Addrs are the listening addresses of all listeners, in the order of the protoAddrs passed to ServeMulti,
+	// Addrs[0] is always the same as Addr.
+	Addrs []net.Addr
+
 	// NumEventLoop is the number of event-loops that the server is using.
 	NumEventLoop int
 
@@ -54,14 +59,42 @@ type Server struct {
 
 // CountConnections counts the number of currently active connections and returns it.
 func (s Server) CountConnections() (count int) {
-	s.svr.lb.iterate(func(i int, el *eventloop) bool {
-		count += int(atomic.LoadInt32(&el.connCount))
-		return true
-	})
-	return
+	return s.svr.countConns()
+}
+
+// Stats returns a snapshot of the metrics of server and its event-loops.
+func (s Server) Stats() Stats {
+	return s.svr.stats()
+}
+
+// MetricsHandler returns an http.Handler serving the metrics of server in the Prometheus text-based exposition
+// format, it can be mounted on any path of any http.ServeMux, e.g. http.Handle("/metrics", s.MetricsHandler()).
+func (s Server) MetricsHandler() http.Handler {
+	return s.svr.metricsHandler()
+}
+
+// ScaleEventLoops adds or retires event-loops at runtime to make the number of them n, e.g. to follow the number of
+// CPUs available to a container.
+//
+// New event-loops start taking new connections right away. Event-loops are retired in the reverse order of their
+// indexes: each one stops taking new connections and migrates its connections to the remaining event-loops chosen by
+// the load-balancer, along with their buffers, timers and deadlines, the event handlers of connections are called
+// in the new event-loops afterwards. It blocks until the connections have been migrated.
+//
+// It fails with ErrServerNotStarted if called before the event-loops are started, e.g. in OnInitComplete, and with
+// ErrServerInShutdown once the server starts draining or shutting down. NumEventLoop of Server is not updated.
+func (s Server) ScaleEventLoops(n int) error {
+	return s.svr.scale(n)
 }
 
-// DupFd returns a copy of the underlying file descriptor of listener.
+// RebalanceConnections evens out the number of connections among event-loops by migrating the surplus connections
+// of the busiest event-loops to the idlest ones as Conn.MigrateTo does, e.g. to spread the connections over the
+// event-loops added by ScaleEventLoops. It returns without waiting for the migrations.
+func (s Server) RebalanceConnections() {
+	s.svr.rebalance()
+}
+
+// DupFd returns a copy of the underlying file descriptor of listener, the first one if served by ServeMulti.
 // It is the caller's responsibility to close dupFD when finished.
 // Closing listener does not affect dupFD, and closing dupFD does not affect listener.
 func (s Server) DupFd() (dupFD int, err error) {
@@ -114,20 +147,87 @@ type Conn interface {
 	SendTo(buf []byte) error
 
 	// AsyncWrite writes data to client/connection asynchronously, usually you would call it in individual goroutines
-	// instead of the event-loop goroutines.
+	// instead of the event-loop goroutines. It fails with errors.ErrAsyncTaskQueueFull if the task queue of
+	// event-loop is bounded by WithAsyncTaskQueueCapacity and full.
 	AsyncWrite(buf []byte) error
 
-	// Wake triggers a React event for this connection.
+	// Writev encodes every buffer as an individual frame and writes them all to client in one system call,
+	// it must be called inside the event-loop which owns the connection, e.g. in React,
+	// use AsyncWritev in individual goroutines instead.
+	Writev(bs [][]byte) error
+
+	// AsyncWritev is the asynchronous version of Writev, usually you would call it in individual goroutines
+	// instead of the event-loop goroutines.
+	AsyncWritev(bs [][]byte) error
+
+	// SendFile queues up the given segment of file to be sent to client by sendfile(2) without copying it into
+	// user space, the segment is sent after all data written before and ahead of the data written afterwards.
+	// The file descriptor is duplicated, so the file can be closed as soon as SendFile returns.
+	// It must be called inside the event-loop which owns the connection, e.g. in React.
+	SendFile(f *os.File, offset, length int64) error
+
+	// Wake triggers a React event for this connection, it fails with errors.ErrAsyncTaskQueueFull like AsyncWrite.
 	Wake() error
 
-	// Close closes the current connection.
+	// Close closes the current connection after the asynchronous writes triggered before, it never fails for a full
+	// task queue.
 	Close() error
+
+	// SetReadDeadline sets up the deadline for the peer to send data, if no data arrives before it,
+	// the connection will be closed and OnClosed fires with errors.ErrReadTimeout.
+	// The deadline is cleared once data arrive, a zero value for t clears it as well.
+	SetReadDeadline(t time.Time) error
+
+	// SetWriteDeadline sets up the deadline for flushing the outbound data, if there are still data waiting to
+	// be written to the peer when it passes, the connection will be closed and OnClosed fires with
+	// errors.ErrWriteTimeout. A zero value for t clears the deadline.
+	SetWriteDeadline(t time.Time) error
+
+	// MigrateTo hands the connection over to the event-loop with the given index asynchronously, along with its
+	// buffers, context, timers and deadlines, e.g. to serve related connections in the same event-loop.
+	// The data written and the tasks triggered by AsyncWrite, Wake, etc. keep their order across the migration,
+	// and the event handlers of connection are called in the new event-loop after it.
+	// It fails with errors.ErrInvalidLoopIndex if there is no such event-loop.
+	MigrateTo(loopIndex int) error
+
+	// PauseRead stops reading from the connection asynchronously until ResumeRead is called, so that the peer is
+	// throttled by the flow control of transport once the socket receive buffer fills up. The frames already read
+	// are still delivered to React. Reading is paused by Options.OutboundHighWatermark as well, it's resumed only
+	// when neither of them is holding it.
+	PauseRead() error
+
+	// ResumeRead resumes reading from the connection paused by PauseRead asynchronously.
+	ResumeRead() error
+
+	// Offload hands a copy of frame over to work running in the worker pool, e.g. for blocking handlers, the out
+	// returned by work is written back and the action is taken in the event-loop of connection. The replies of
+	// offloaded frames and the ones returned by React are written in the order of frames, the out returned by the
+	// React which offloads a frame follows the reply of that frame. No more frames are decoded or read from the
+	// connection while it has Options.MaxInflightOffloads frames in flight. It fails with
+	// errors.ErrWorkerPoolOverload if there is no idle worker, bounded by Options.WorkerPoolSize.
+	// It must be called inside the event-loop which owns the connection, e.g. in React.
+	Offload(frame []byte, work func(frame []byte) (out []byte, action Action)) error
 }
 
 type (
 	// EventHandler represents the server events' callbacks for the Serve call.
 	// Each event has an Action return value that is used manage the state
 	// of the connection and server.
+	//
+	// An EventHandler may also implement the following methods, which are called if they're present:
+	//
+	//	// OnDraining fires on every connection when the server starts draining in Stop, new connections are not
+	//	// accepted any more by then. Returning Close closes the connection as soon as its outbound data are
+	//	// flushed, returning None keeps serving it until it's closed by either side or the deadline of Stop passes.
+	//	// The connection is closed as if Close is returned if it's absent.
+	//	OnDraining(c Conn) (action Action)
+	//
+	//	// OnWritabilityChanged fires when the outbound buffer of connection grows beyond
+	//	// Options.OutboundHighWatermark with writable false, reading from the connection is paused by then, and fires
+	//	// again with writable true once the buffer is drained to Options.OutboundLowWatermark and reading is resumed.
+	//	// It fires asynchronously in the event-loop after the change, so the writability of connection may have
+	//	// changed again by then, which is reported by the next invocation.
+	//	OnWritabilityChanged(c Conn, writable bool) (action Action)
 	EventHandler interface {
 		// OnInitComplete fires when the server is ready for accepting connections.
 		// The parameter:server has information and various utilities.
@@ -163,6 +263,17 @@ type (
 		Tick() (delay time.Duration, action Action)
 	}
 
+	// drainer is implemented by the EventHandler which handles the connections being drained, see EventHandler.
+	drainer interface {
+		OnDraining(c Conn) (action Action)
+	}
+
+	// writabilityWatcher is implemented by the EventHandler which watches the writability of connections,
+	// see EventHandler.
+	writabilityWatcher interface {
+		OnWritabilityChanged(c Conn, writable bool) (action Action)
+	}
+
 	// EventServer is a built-in implementation of EventHandler which sets up each method with a default implementation,
 	// you can compose it with your own implementation of EventHandler when you don't want to implement all methods
 	// in EventHandler.
@@ -194,6 +305,17 @@ func (es *EventServer) OnClosed(c Conn, err error) (action Action) {
 	return
 }
 
+// OnDraining fires on every connection when the server starts draining in Stop,
+// the connection is closed as soon as its outbound data are flushed by default.
+func (es *EventServer) OnDraining(c Conn) (action Action) {
+	return Close
+}
+
+// OnWritabilityChanged fires when the outbound buffer of connection crosses its watermarks.
+func (es *EventServer) OnWritabilityChanged(c Conn, writable bool) (action Action) {
+	return
+}
+
 // PreWrite fires just before any data is written to any client socket, this event function is usually used to
 // put some code of logging/counting/reporting or any prepositive operations before writing data to client.
 func (es *EventServer) PreWrite() {
@@ -216,6 +338,8 @@ func (es *EventServer) Tick() (delay time.Duration, action Action) {
 //
 // Address should use a scheme prefix and be formatted
 // like `tcp://192.168.0.10:9851` or `unix://socket`.
+// A Unix Domain Socket address starting with '@', like `unix://@socket`,
+// is bound in the Linux abstract namespace instead of the file system.
 // Valid network schemes:
 //  tcp   - bind to both IPv4 and IPv6
 //  tcp4  - IPv4
@@ -225,8 +349,30 @@ func (es *EventServer) Tick() (delay time.Duration, action Action) {
 //  udp6  - IPv6
 //  unix  - Unix Domain Socket
 //
+// A listening socket passed in by a socket-activating supervisor can be served as well, its network is
+// figured out from the socket itself:
+//  fd://N           - the fd numbered N
+//  listen-fds://    - the first fd passed in by LISTEN_FDS, which is only taken if LISTEN_PID is the current process
+//  listen-fds://N   - the N-th fd passed in by LISTEN_FDS, counting from 0
+//  listen-fds://foo - the fd named foo in LISTEN_FDNAMES
+// LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES are unset once taken. The process started by Restart serves the
+// same addresses with the sockets handed over by its parent.
+//
 // The "tcp" network scheme is assumed when one is not specified.
 func Serve(eventHandler EventHandler, protoAddr string, opts ...Option) (err error) {
+	return ServeMulti(eventHandler, []string{protoAddr}, opts...)
+}
+
+// ServeMulti starts handling events on multiple listeners with one server, the addresses take the same formats as
+// the one passed to Serve and may be mixed with different networks, e.g. "tcp://:9000", "tcp://:9001" and
+// "unix:///tmp/gnet.sock". All the connections share the same event-loops, use Conn.LocalAddr to tell which
+// listener a connection comes from.
+//
+// The server can be stopped by calling Stop with any of protoAddrs.
+func ServeMulti(eventHandler EventHandler, protoAddrs []string, opts ...Option) (err error) {
+	if len(protoAddrs) == 0 {
+		return errors.ErrNoAddress
+	}
 	options := loadOptions(opts...)
 
 	if options.Logger != nil {
@@ -248,34 +394,51 @@ func Serve(eventHandler EventHandler, protoAddr string, opts ...Option) (err err
 		options.ReadBufferCap = internal.CeilToPowerOfTwo(rbc)
 	}
 
-	network, addr := parseProtoAddr(protoAddr)
+	if low := options.OutboundLowWatermark; low <= 0 || low > options.OutboundHighWatermark {
+		options.OutboundLowWatermark = options.OutboundHighWatermark / 2
+	}
 
-	var ln *listener
+	lns := make([]*listener, 0, len(protoAddrs))
+	defer func() {
+		for _, ln := range lns {
+			ln.close()
+		}
+	}()
 	// 初始化Listen，最后调用unix.Listen()接口进行端口监听
 	// network 是网络类型, addr 是监听地址，重用接口是什么意思？
 	/*
 		SO_REUSEADDR 的作用
 		1. 允许启动一个监听服务器并捆绑其众所周知的接口，及时以前建立的将该端口用作其本地端口的连接依然存在。
 	*/
-	if ln, err = initListener(network, addr, options.ReusePort); err != nil {
-		return
+	for _, protoAddr := range protoAddrs {
+		network, addr := parseProtoAddr(protoAddr)
+		var ln *listener
+		if ln, err = initListener(network, addr, options); err != nil {
+			return
+		}
+		lns = append(lns, ln)
 	}
-	defer ln.close()
 	// 开启服务，通过传入listener对象实现上下文关联
-	return serve(eventHandler, ln, options, protoAddr)
+	return serve(eventHandler, lns, options, protoAddrs)
 }
 
 // shutdownPollInterval is how often we poll to check whether server has been shut down during gnet.Stop().
 var shutdownPollInterval = 500 * time.Millisecond
 
-// Stop gracefully shuts down the server without interrupting any active eventloops,
-// it waits indefinitely for connections and eventloops to be closed and then shuts down.
+// Stop gracefully shuts down the server without interrupting any active eventloops.
+//
+// It stops accepting new connections and fires OnDraining of EventHandler on every connection first, then waits for
+// all connections to be closed and shuts down. When ctx is done before that, the remaining connections are closed
+// forcibly with a best-effort flush of their outbound data, and ctx.Err() is returned.
 func Stop(ctx context.Context, protoAddr string) error {
 	var svr *server
 	if s, ok := serverFarm.Load(protoAddr); ok {
 		svr = s.(*server)
-		svr.signalShutdown()
-		defer serverFarm.Delete(protoAddr)
+		defer func() {
+			for _, protoAddr := range svr.protoAddrs {
+				serverFarm.Delete(protoAddr)
+			}
+		}()
 	} else {
 		return errors.ErrServerInShutdown
 	}
@@ -283,6 +446,7 @@ func Stop(ctx context.Context, protoAddr string) error {
 	if svr.isInShutdown() {
 		return errors.ErrServerInShutdown
 	}
+	svr.drain()
 
 	ticker := time.NewTicker(shutdownPollInterval)
 	defer ticker.Stop()
@@ -290,8 +454,12 @@ func Stop(ctx context.Context, protoAddr string) error {
 		if svr.isInShutdown() {
 			return nil
 		}
+		if svr.countConns() == 0 {
+			svr.signalShutdown()
+		}
 		select {
 		case <-ctx.Done():
+			svr.signalShutdown()
 			return ctx.Err()
 		case <-ticker.C:
 		}
@@ -300,10 +468,11 @@ func Stop(ctx context.Context, protoAddr string) error {
 
 func parseProtoAddr(addr string) (network, address string) {
 	network = "tcp"
-	address = strings.ToLower(addr)
+	address = addr
 	if strings.Contains(address, "://") {
-		pair := strings.Split(address, "://")
-		network = pair[0]
+		pair := strings.SplitN(address, "://", 2)
+		// Only the scheme is case-insensitive, Unix Domain Socket paths are not.
+		network = strings.ToLower(pair[0])
 		address = pair[1]
 	}
 	return
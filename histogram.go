@@ -0,0 +1,97 @@
+package shpnetpoll
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// histogramBounds are the upper bounds of the buckets of latency histograms, doubling from 1µs to about 16s.
+var histogramBounds = func() []time.Duration {
+	bounds := make([]time.Duration, 25)
+	for i := range bounds {
+		bounds[i] = time.Microsecond << uint(i)
+	}
+	return bounds
+}()
+
+// histogram counts durations into the buckets bounded by histogramBounds,
+// it's updated by one goroutine and read from any goroutine.
+type histogram struct {
+	sum    int64 // nanoseconds, kept first for 64-bit alignment
+	counts [26]uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	if d > time.Microsecond {
+		// The smallest i with d <= 1µs<<i.
+		i = bits.Len64(uint64((d - 1) / time.Microsecond))
+	}
+	if i > len(histogramBounds) {
+		i = len(histogramBounds)
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+func (h *histogram) snapshot() (s Histogram) {
+	s.Bounds = histogramBounds
+	s.Counts = make([]uint64, len(h.counts))
+	for i := range h.counts {
+		s.Counts[i] = atomic.LoadUint64(&h.counts[i])
+		s.Count += s.Counts[i]
+	}
+	s.Sum = time.Duration(atomic.LoadInt64(&h.sum))
+	return
+}
+
+// Histogram is a snapshot of the distribution of durations.
+type Histogram struct {
+	// Bounds are the upper bounds of buckets in ascending order, the last bucket in Counts is unbounded.
+	Bounds []time.Duration
+
+	// Counts are the numbers of durations falling into every bucket, they are not cumulative.
+	Counts []uint64
+
+	// Count is the number of all durations.
+	Count uint64
+
+	// Sum is the sum of all durations.
+	Sum time.Duration
+}
+
+// Quantile estimates the q-quantile of durations, 0 <= q <= 1, by the upper bound of the bucket it falls into,
+// it returns the largest bound for the unbounded bucket and 0 if there is no duration.
+func (h Histogram) Quantile(q float64) time.Duration {
+	rank := uint64(q * float64(h.Count))
+	var n uint64
+	for i, count := range h.Counts {
+		if n += count; count > 0 && n >= rank {
+			if i < len(h.Bounds) {
+				return h.Bounds[i]
+			}
+			break
+		}
+	}
+	if h.Count == 0 || len(h.Bounds) == 0 {
+		return 0
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+// add merges the durations of o into h.
+func (h *Histogram) add(o Histogram) {
+	if o.Bounds == nil {
+		return
+	}
+	if h.Bounds == nil {
+		h.Bounds = o.Bounds
+		h.Counts = make([]uint64, len(o.Counts))
+	}
+	for i, count := range o.Counts {
+		h.Counts[i] += count
+	}
+	h.Count += o.Count
+	h.Sum += o.Sum
+}
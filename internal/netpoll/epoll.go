@@ -6,6 +6,7 @@ import (
 	"os"
 	"runtime"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -14,19 +15,43 @@ import (
 	"shpnetpoll/internal/netpoll/queue"
 )
 
-// Poller represents a poller which is in charge of monitoring file-descriptors.
-type Poller struct {
+// epollPoller is the Poller built on top of epoll.
+type epollPoller struct {
+	latency               // kept first for 64-bit alignment
 	fd             int    // epoll fd
 	wfd            int    // wake fd
 	wfdBuf         []byte // wfd buffer to read packet
 	netpollWakeSig int32
 	// 这个异步线程队列是每个线程独享的
 	asyncTaskQueue queue.AsyncTaskQueue
+	urgentQueue    queue.AsyncTaskQueue
+	wakeGuard
+	timer    Timer    // timer driven by the timeout of epoll_wait
+	observer Observer // observer of handling network-events and tasks, nil if there is none
 }
 
-// OpenPoller instantiates a poller.
-func OpenPoller() (poller *Poller, err error) {
-	poller = new(Poller)
+// SetTimer sets up the timer to be driven by the poller, it must be called before Polling.
+func (p *epollPoller) SetTimer(timer Timer) {
+	p.timer = timer
+}
+
+// SetObserver sets up the observer of handling network-events and tasks, it must be called before Polling.
+func (p *epollPoller) SetObserver(observer Observer) {
+	p.observer = observer
+}
+
+// OpenPoller instantiates an epoll-based poller, the normal lane of asynchronous tasks holds up to
+// taskQueueCap tasks, or is unbounded if taskQueueCap is not positive.
+func OpenPoller(taskQueueCap int) (Poller, error) {
+	p, err := openEpollPoller(taskQueueCap)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func openEpollPoller(taskQueueCap int) (poller *epollPoller, err error) {
+	poller = new(epollPoller)
 	if poller.fd, err = unix.EpollCreate1(unix.EPOLL_CLOEXEC); err != nil {
 		poller = nil
 		err = os.NewSyscallError("epoll_create1", err)
@@ -44,12 +69,14 @@ func OpenPoller() (poller *Poller, err error) {
 		poller = nil
 		return
 	}
-	poller.asyncTaskQueue = queue.NewLockFreeQueue()
+	poller.asyncTaskQueue = newTaskQueue(taskQueueCap)
+	poller.urgentQueue = queue.NewLockFreeQueue()
 	return
 }
 
 // Close closes the poller.
-func (p *Poller) Close() error {
+func (p *epollPoller) Close() error {
+	p.shut()
 	if err := os.NewSyscallError("close", unix.Close(p.fd)); err != nil {
 		return err
 	}
@@ -63,20 +90,53 @@ var (
 	b        = (*(*[8]byte)(unsafe.Pointer(&u)))[:]
 )
 
-// Trigger wakes up the poller blocked in waiting for network-events and runs jobs in asyncTaskQueue.
-func (p *Poller) Trigger(task queue.Task) (err error) {
+// PendingTasks returns the number of tasks waiting in both lanes.
+func (p *epollPoller) PendingTasks() int {
+	return p.urgentQueue.Len() + p.asyncTaskQueue.Len()
+}
+
+// TriggeredTasks returns the number of tasks ever put in both lanes.
+func (p *epollPoller) TriggeredTasks() uint64 {
+	return p.urgentQueue.Total() + p.asyncTaskQueue.Total()
+}
+
+// Trigger wakes up the poller blocked in waiting for network-events and runs jobs in asyncTaskQueue,
+// it fails with errors.ErrAsyncTaskQueueFull if asyncTaskQueue is full.
+func (p *epollPoller) Trigger(task queue.Task) error {
 	// 任务入队
-	p.asyncTaskQueue.Enqueue(task)
+	if !p.asyncTaskQueue.Enqueue(task) {
+		return errors.ErrAsyncTaskQueueFull
+	}
+	return p.notify()
+}
+
+// UrgentTrigger is Trigger in the high-priority lane, the task is never rejected and runs ahead of all tasks
+// waiting in asyncTaskQueue.
+func (p *epollPoller) UrgentTrigger(task queue.Task) error {
+	p.urgentQueue.Enqueue(task)
+	return p.notify()
+}
+
+// notify writes to the eventfd unless the poller has been woken up and not run the tasks yet,
+// it fails with errors.ErrPollerClosed if the poller has been closed.
+func (p *epollPoller) notify() (err error) {
+	if atomic.LoadInt32(&p.closed) == 1 {
+		return errors.ErrPollerClosed
+	}
 	if atomic.CompareAndSwapInt32(&p.netpollWakeSig, 0, 1) {
+		if !p.enterWake() {
+			return errors.ErrPollerClosed
+		}
 		for _, err = unix.Write(p.wfd, b); err == unix.EINTR || err == unix.EAGAIN; _, err = unix.Write(p.wfd, b) {
 		}
+		p.exitWake()
 	}
 	return os.NewSyscallError("write", err)
 }
 
 // 每一个reactor实际执行循环的函数
 // Polling blocks the current goroutine, waiting for network-events.
-func (p *Poller) Polling(callback func(fd int, ev uint32) error) error {
+func (p *epollPoller) Polling(callback func(fd int, ev uint32) error) error {
 	// 创建时间列表集合
 	el := newEventList(InitEvents)
 	var wakenUp bool
@@ -85,9 +145,12 @@ func (p *Poller) Polling(callback func(fd int, ev uint32) error) error {
 	for {
 		// 在这里监听可以使用的描述符，p.fd是epoll占用的，是el.events存放返回的事件，并进行处理
 		// mainLoop中的p.fd就是 监听的epoll的fd
-		n, err := unix.EpollWait(p.fd, el.events, msec)
+		n, err := unix.EpollWait(p.fd, el.events, pollTimeout(p.timer, msec))
 		if n == 0 || (n < 0 && err == unix.EINTR) {
 			msec = -1
+			if err = expireTimer(p.timer); err != nil {
+				return err
+			}
 			// 主动让出cpu调度
 			runtime.Gosched()
 			continue
@@ -96,13 +159,14 @@ func (p *Poller) Polling(callback func(fd int, ev uint32) error) error {
 			return err
 		}
 		msec = 0
+		start := time.Now()
 
 		for i := 0; i < n; i++ {
 			// 主进程在这里一定是一直可读
 			// TODO 这里的fd会不会包含其他eventloop的wfd ?????? 应该是会包括的，否则也不会进行判断
 			if fd := int(el.events[i].Fd); fd != p.wfd {
 				// 回调函数，当有读事件发生时执行回调函数
-				switch err = callback(fd, el.events[i].Events); err {
+				switch err = runCallback(p.observer, callback, fd, el.events[i].Events, start); err {
 				case nil:
 				case errors.ErrAcceptSocket, errors.ErrServerShutdown:
 					return err
@@ -136,19 +200,8 @@ func (p *Poller) Polling(callback func(fd int, ev uint32) error) error {
 		// 这边是干什么的？用于进程间通信？因为wfd通过 EventFd函数创建？待了解相关实现
 		if wakenUp {
 			wakenUp = false
-			var task queue.Task
-			for i := 0; i < AsyncTasks; i++ {
-				// 任务出队
-				if task = p.asyncTaskQueue.Dequeue(); task == nil {
-					break
-				}
-				switch err = task(); err {
-				case nil:
-				case errors.ErrServerShutdown:
-					return err
-				default:
-					logging.DefaultLogger.Warnf("Error occurs in user-defined function, %v", err)
-				}
+			if err = runTasks(p.observer, p.urgentQueue, p.asyncTaskQueue); err != nil {
+				return err
 			}
 			atomic.StoreInt32(&p.netpollWakeSig, 0)
 			// 这里怎么解读？
@@ -156,7 +209,7 @@ func (p *Poller) Polling(callback func(fd int, ev uint32) error) error {
 			// 这里为了性能不是每一个都去检查是否有异步任务，而是通过eventFD尽心消息通知？？
 			// 这里感觉有点脱裤子放屁？
 			// TODO 如果异步队列不空，就写入数据，使得wfd上发生可读时间，触发上述逻辑，猜测这里是为了防止
-			if !p.asyncTaskQueue.Empty() {
+			if !p.urgentQueue.Empty() || !p.asyncTaskQueue.Empty() {
 				// 将缓冲区的8字节正兴致加到内核计数器上
 				/*
 						EAGAIN : Resource temporarily unavailable
@@ -181,6 +234,11 @@ func (p *Poller) Polling(callback func(fd int, ev uint32) error) error {
 			}
 		}
 
+		p.record(start)
+		if err = expireTimer(p.timer); err != nil {
+			return err
+		}
+
 		if n == el.size {
 			el.expand()
 		} else if n < el.size>>1 {
@@ -193,39 +251,60 @@ const (
 	readEvents      = unix.EPOLLPRI | unix.EPOLLIN
 	writeEvents     = unix.EPOLLOUT
 	readWriteEvents = readEvents | writeEvents
+	edgeEvents      = readWriteEvents | unix.EPOLLRDHUP | unix.EPOLLET
 )
 
 // AddReadWrite registers the given file-descriptor with readable and writable events to the poller.
-func (p *Poller) AddReadWrite(fd int) error {
+func (p *epollPoller) AddReadWrite(fd int) error {
 	return os.NewSyscallError("epoll_ctl add",
 		unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: readWriteEvents}))
 }
 
 // AddRead registers the given file-descriptor with readable event to the poller.
-func (p *Poller) AddRead(fd int) error {
+func (p *epollPoller) AddRead(fd int) error {
 	return os.NewSyscallError("epoll_ctl add",
 		unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: readEvents}))
 }
 
 // AddWrite registers the given file-descriptor with writable event to the poller.
-func (p *Poller) AddWrite(fd int) error {
+func (p *epollPoller) AddWrite(fd int) error {
 	return os.NewSyscallError("epoll_ctl add",
 		unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: writeEvents}))
 }
 
+// AddReadWriteET registers the given file-descriptor with edge-triggered readable and writable events to the poller,
+// the caller must drain the file-descriptor until EAGAIN on every event since it won't be reported again.
+func (p *epollPoller) AddReadWriteET(fd int) error {
+	return os.NewSyscallError("epoll_ctl add",
+		unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: edgeEvents}))
+}
+
 // ModRead renews the given file-descriptor with readable event in the poller.
-func (p *Poller) ModRead(fd int) error {
+func (p *epollPoller) ModRead(fd int) error {
 	return os.NewSyscallError("epoll_ctl mod",
 		unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: readEvents}))
 }
 
 // ModReadWrite renews the given file-descriptor with readable and writable events in the poller.
-func (p *Poller) ModReadWrite(fd int) error {
+func (p *epollPoller) ModReadWrite(fd int) error {
 	return os.NewSyscallError("epoll_ctl mod",
 		unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: readWriteEvents}))
 }
 
+// ModWrite renews the given file-descriptor with writable event in the poller.
+func (p *epollPoller) ModWrite(fd int) error {
+	return os.NewSyscallError("epoll_ctl mod",
+		unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: writeEvents}))
+}
+
+// ModNone renews the given file-descriptor without readable and writable events in the poller,
+// only the errors and hang-ups of it are reported then.
+func (p *epollPoller) ModNone(fd int) error {
+	return os.NewSyscallError("epoll_ctl mod",
+		unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd)}))
+}
+
 // Delete removes the given file-descriptor from the poller.
-func (p *Poller) Delete(fd int) error {
+func (p *epollPoller) Delete(fd int) error {
 	return os.NewSyscallError("epoll_ctl del", unix.EpollCtl(p.fd, unix.EPOLL_CTL_DEL, fd, nil))
 }
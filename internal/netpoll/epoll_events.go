@@ -12,6 +12,9 @@ const (
 	// ErrEvents represents exceptional events that are not read/write, like socket being closed,
 	// reading/writing from/to a closed socket, etc.
 	ErrEvents = unix.EPOLLERR | unix.EPOLLHUP | unix.EPOLLRDHUP
+	// HupEvents represents the exceptional events which are reported even if the file-descriptor is not watched
+	// for reading or writing.
+	HupEvents = unix.EPOLLERR | unix.EPOLLHUP
 	// OutEvents combines EPOLLOUT event and some exceptional events.
 	OutEvents = ErrEvents | unix.EPOLLOUT
 	// InEvents combines EPOLLIN/EPOLLPRI events and some exceptional events.
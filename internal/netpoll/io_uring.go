@@ -0,0 +1,1214 @@
+// +build linux
+
+package netpoll
+
+import (
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"shpnetpoll/errors"
+	"shpnetpoll/internal/logging"
+	"shpnetpoll/internal/netpoll/queue"
+)
+
+const (
+	// uringEntries is the number of submission queue entries of every ring,
+	// the completion queue is twice as large.
+	uringEntries = 1024
+
+	// uringBufferBudget is the number of bytes of the buffers registered to every ring,
+	// a quarter of them are for sending and the rest for receiving.
+	uringBufferBudget = 2 << 20
+	// uringMinBuffers and uringMaxBuffers bound the number of registered buffers, the latter is UIO_MAXIOV.
+	uringMinBuffers = 4
+	uringMaxBuffers = 1024
+
+	uringOffSQRing = 0
+	uringOffCQRing = 0x8000000
+	uringOffSQEs   = 0x10000000
+
+	uringFeatSingleMmap = 1 << 0
+	uringFeatNoDrop     = 1 << 1
+	uringFeatFastPoll   = 1 << 5
+
+	uringEnterGetEvents = 1 << 0
+
+	uringRegisterBuffers = 0
+
+	uringOpReadFixed     = 4
+	uringOpWriteFixed    = 5
+	uringOpPollAdd       = 6
+	uringOpPollRemove    = 7
+	uringOpTimeout       = 11
+	uringOpTimeoutRemove = 12
+	uringOpAccept        = 13
+	uringOpAsyncCancel   = 14
+)
+
+// The kind of user data is kept in its highest byte, a request also carries its index in the requests of poller.
+const (
+	uringRequestData uint64 = iota << 56
+	uringTimeout
+	uringIgnored
+)
+
+// Kinds of file-descriptors registered to the io_uring poller.
+const (
+	uringPolled   = iota // watched by poll requests only
+	uringStream          // connected stream socket, received from and sent to by the poller
+	uringAcceptor        // listener whose connections are accepted by the poller
+)
+
+// uringSQE mirrors struct io_uring_sqe.
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	_           [2]uint64
+}
+
+// uringCQE mirrors struct io_uring_cqe.
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uringSQRingOffsets mirrors struct io_sqring_offsets.
+type uringSQRingOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	resv2                                                           uint64
+}
+
+// uringCQRingOffsets mirrors struct io_cqring_offsets.
+type uringCQRingOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	resv2                                                           uint64
+}
+
+// uringParams mirrors struct io_uring_params.
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  uringSQRingOffsets
+	cqOff                                                                  uringCQRingOffsets
+}
+
+// uringTimespec mirrors struct __kernel_timespec.
+type uringTimespec struct {
+	sec, nsec int64
+}
+
+// uringRequest is a request in flight, its index in the requests of poller is carried by its user data.
+// It's kept until its completion is reaped, even if it has been called off in the meantime.
+type uringRequest struct {
+	idx   int
+	st    *uringFdState
+	op    uint8
+	buf   int // registered buffer in use, -1 if there is none
+	off   int // bytes of the buffer sent so far
+	n     int // bytes of the buffer to send
+	sa    unix.RawSockaddrAny
+	saLen uint32
+}
+
+func (req *uringRequest) userData() uint64 {
+	return uringRequestData | uint64(req.idx)
+}
+
+// uringFdState is a file-descriptor registered to the io_uring poller, along with its requests in flight
+// and the results of the completed ones which have not been taken yet.
+type uringFdState struct {
+	fd         int
+	kind       int
+	events     uint32        // events of interest
+	poll       *uringRequest // poll request in flight, if any
+	pollEvents uint32        // events watched by the poll request in flight
+	recv       *uringRequest // receive request in flight, if any
+	send       *uringRequest // send request in flight, if any
+	accept     *uringRequest // accept request in flight, if any
+
+	recvHeld   bool
+	recvRes    int32 // number of bytes received, or the negated errno
+	recvBuf    int   // registered buffer holding the data received, -1 if there is none
+	sentHeld   bool
+	sentRes    int32 // number of bytes sent, or the negated errno
+	acceptHeld bool
+	acceptRes  int32 // connection accepted, or the negated errno
+	acceptSa   unix.Sockaddr
+
+	dirty   bool // whether the requests are to be brought in line with the events of interest
+	ready   bool // whether the results held are to be reported again
+	deleted bool
+}
+
+// uringPoller is the Poller built on top of io_uring, it's also a Completer.
+//
+// Listeners registered by AddAcceptor are accepted from by IORING_OP_ACCEPT, streams registered by AddStream are
+// received from by IORING_OP_READ_FIXED and sent to by IORING_OP_WRITE_FIXED with the buffers registered to the ring,
+// the completions of those are reported to the callback of Polling as the readable and writable events, and their
+// results, errors included, are taken by Accepted, Recv and Sent. The other file-descriptors, and the streams while
+// the registered buffers run out, are watched by one-shot IORING_OP_POLL_ADD requests which are re-armed after their
+// events have been handled, so they behave like a level-triggered epoll.
+//
+// Requests are only queued as SQEs while handling events, they are submitted along with waiting for the completions
+// by a single io_uring_enter per iteration, except for calling off the requests in flight of a file-descriptor
+// being read in place or deleted, whose completions are waited for.
+type uringPoller struct {
+	latency               // kept first for 64-bit alignment
+	fd             int    // io_uring fd
+	wfd            int    // wake fd
+	wfdBuf         []byte // wfd buffer to read packet
+	netpollWakeSig int32
+	asyncTaskQueue queue.AsyncTaskQueue
+	urgentQueue    queue.AsyncTaskQueue
+	wakeGuard
+	timer    Timer    // timer driven by the IORING_OP_TIMEOUT requests
+	observer Observer // observer of handling network-events and tasks, nil if there is none
+
+	sqMem, cqMem, sqeMem []byte
+	sqHead, sqTail       *uint32
+	cqHead, cqTail       *uint32
+	sqMask, cqMask       uint32
+	sqEntries            uint32
+	sqes                 []uringSQE
+	cqes                 []uringCQE
+
+	completes bool // whether accepts, receives and sends are completed by the poller
+	bufMem    []byte
+	bufSize   int
+	recvBufs  []int // free registered buffers for receiving
+	sendBufs  []int // free registered buffers for sending
+	spent     []int // buffers of the data taken, which are free once the poller goes on waiting
+
+	fds          map[int]*uringFdState
+	detached     map[int]*uringFdState // listeners deleted with a connection accepted but not taken yet
+	reqs         []*uringRequest
+	freeReqs     []int
+	dirty        []*uringFdState // file-descriptors whose requests are re-armed before waiting
+	ready        []*uringFdState // file-descriptors whose results held are reported again
+	deferred     []uringCQE      // completions reaped while waiting for the requests being called off
+	ts           uringTimespec
+	timeoutGen   uint32
+	timeoutArmed bool
+	timeoutAt    time.Time
+}
+
+// OpenIOUringPoller instantiates an io_uring-based poller, it fails if the kernel doesn't support io_uring
+// or is older than 5.5 on which the completion events may be dropped. Accepts, receives and sends are completed by
+// the poller on Linux 5.7+, with the registered buffers of bufferSize bytes if it is positive. The normal lane of
+// asynchronous tasks holds up to taskQueueCap tasks, or is unbounded if taskQueueCap is not positive.
+func OpenIOUringPoller(taskQueueCap, bufferSize int) (Poller, error) {
+	p, err := openIOUringPoller(taskQueueCap, bufferSize)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func openIOUringPoller(taskQueueCap, bufferSize int) (poller *uringPoller, err error) {
+	var params uringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uringEntries, uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("io_uring_setup", errno)
+	}
+	poller = &uringPoller{fd: int(fd), wfd: -1, fds: make(map[int]*uringFdState), detached: make(map[int]*uringFdState)}
+	if params.features&uringFeatNoDrop == 0 {
+		_ = poller.Close()
+		return nil, os.NewSyscallError("io_uring_setup", unix.ENOSYS)
+	}
+	if err = poller.mmap(&params); err != nil {
+		_ = poller.Close()
+		return nil, err
+	}
+	// Accepts, receives and sends on non-blocking sockets would fail with EAGAIN instead of waiting for the sockets
+	// without the internal polling of io_uring.
+	if poller.completes = params.features&uringFeatFastPoll != 0; poller.completes && bufferSize > 0 {
+		if err = poller.registerBuffers(bufferSize); err != nil {
+			logging.DefaultLogger.Warnf("io_uring falls back to receiving and sending through syscalls: %v", err)
+		}
+	}
+	if poller.wfd, err = unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC); err != nil {
+		_ = poller.Close()
+		return nil, os.NewSyscallError("eventfd", err)
+	}
+	poller.wfdBuf = make([]byte, 8)
+	if err = poller.AddRead(poller.wfd); err != nil {
+		_ = poller.Close()
+		return nil, err
+	}
+	poller.asyncTaskQueue = newTaskQueue(taskQueueCap)
+	poller.urgentQueue = queue.NewLockFreeQueue()
+	return
+}
+
+// mmap maps the submission queue, the completion queue and the SQE array of the ring.
+func (p *uringPoller) mmap(params *uringParams) (err error) {
+	sqSize := int(params.sqOff.array + params.sqEntries*4)
+	cqSize := int(params.cqOff.cqes + params.cqEntries*uint32(unsafe.Sizeof(uringCQE{})))
+	singleMmap := params.features&uringFeatSingleMmap != 0
+	if singleMmap && cqSize > sqSize {
+		sqSize = cqSize
+	}
+
+	prot, flags := unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE
+	if p.sqMem, err = unix.Mmap(p.fd, uringOffSQRing, sqSize, prot, flags); err != nil {
+		return os.NewSyscallError("mmap", err)
+	}
+	p.cqMem = p.sqMem
+	if !singleMmap {
+		if p.cqMem, err = unix.Mmap(p.fd, uringOffCQRing, cqSize, prot, flags); err != nil {
+			return os.NewSyscallError("mmap", err)
+		}
+	}
+	sqeSize := int(params.sqEntries) * int(unsafe.Sizeof(uringSQE{}))
+	if p.sqeMem, err = unix.Mmap(p.fd, uringOffSQEs, sqeSize, prot, flags); err != nil {
+		return os.NewSyscallError("mmap", err)
+	}
+
+	p.sqHead = (*uint32)(unsafe.Pointer(&p.sqMem[params.sqOff.head]))
+	p.sqTail = (*uint32)(unsafe.Pointer(&p.sqMem[params.sqOff.tail]))
+	p.sqMask = *(*uint32)(unsafe.Pointer(&p.sqMem[params.sqOff.ringMask]))
+	p.sqEntries = *(*uint32)(unsafe.Pointer(&p.sqMem[params.sqOff.ringEntries]))
+	p.cqHead = (*uint32)(unsafe.Pointer(&p.cqMem[params.cqOff.head]))
+	p.cqTail = (*uint32)(unsafe.Pointer(&p.cqMem[params.cqOff.tail]))
+	p.cqMask = *(*uint32)(unsafe.Pointer(&p.cqMem[params.cqOff.ringMask]))
+
+	n, m := int(params.sqEntries), int(params.cqEntries)
+	p.sqes = (*[1 << 20]uringSQE)(unsafe.Pointer(&p.sqeMem[0]))[:n:n]
+	p.cqes = (*[1 << 20]uringCQE)(unsafe.Pointer(&p.cqMem[params.cqOff.cqes]))[:m:m]
+	// SQEs are always submitted in order, so the indirection array maps every slot to itself.
+	array := (*[1 << 20]uint32)(unsafe.Pointer(&p.sqMem[params.sqOff.array]))[:n:n]
+	for i := range array {
+		array[i] = uint32(i)
+	}
+	return nil
+}
+
+// registerBuffers maps the buffers of the given size and registers them to the ring, which saves the kernel from
+// mapping the user memory on every receive and send.
+func (p *uringPoller) registerBuffers(size int) error {
+	n := uringBufferBudget / size
+	if n < uringMinBuffers {
+		n = uringMinBuffers
+	} else if n > uringMaxBuffers {
+		n = uringMaxBuffers
+	}
+	mem, err := unix.Mmap(-1, 0, n*size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return os.NewSyscallError("mmap", err)
+	}
+	iovecs := make([]unix.Iovec, n)
+	for i := range iovecs {
+		iovecs[i].Base = &mem[i*size]
+		iovecs[i].SetLen(size)
+	}
+	_, _, errno := unix.Syscall6(unix.SYS_IO_URING_REGISTER,
+		uintptr(p.fd), uringRegisterBuffers, uintptr(unsafe.Pointer(&iovecs[0])), uintptr(n), 0, 0)
+	if errno != 0 {
+		_ = unix.Munmap(mem)
+		return os.NewSyscallError("io_uring_register", errno)
+	}
+	p.bufMem, p.bufSize = mem, size
+	for i := 0; i < n; i++ {
+		if i < n/4 {
+			p.sendBufs = append(p.sendBufs, i)
+		} else {
+			p.recvBufs = append(p.recvBufs, i)
+		}
+	}
+	return nil
+}
+
+// buffer returns the registered buffer of the given index.
+func (p *uringPoller) buffer(i int) []byte {
+	return p.bufMem[i*p.bufSize : (i+1)*p.bufSize : (i+1)*p.bufSize]
+}
+
+// Close closes the poller.
+func (p *uringPoller) Close() error {
+	p.shut()
+	if p.sqeMem != nil {
+		_ = unix.Munmap(p.sqeMem)
+	}
+	if p.cqMem != nil && &p.cqMem[0] != &p.sqMem[0] {
+		_ = unix.Munmap(p.cqMem)
+	}
+	if p.sqMem != nil {
+		_ = unix.Munmap(p.sqMem)
+	}
+	for _, m := range []map[int]*uringFdState{p.fds, p.detached} {
+		for _, st := range m {
+			if st.acceptHeld && st.acceptRes >= 0 {
+				_ = unix.Close(int(st.acceptRes))
+			}
+		}
+	}
+	err := os.NewSyscallError("close", unix.Close(p.fd))
+	// The pages of registered buffers stay pinned until the ring has been torn down, unmapping them is safe.
+	if p.bufMem != nil {
+		_ = unix.Munmap(p.bufMem)
+	}
+	if err != nil {
+		return err
+	}
+	if p.wfd < 0 {
+		return nil
+	}
+	return os.NewSyscallError("close", unix.Close(p.wfd))
+}
+
+// SetTimer sets up the timer to be driven by the poller, it must be called before Polling.
+func (p *uringPoller) SetTimer(timer Timer) {
+	p.timer = timer
+}
+
+// SetObserver sets up the observer of handling network-events and tasks, it must be called before Polling.
+func (p *uringPoller) SetObserver(observer Observer) {
+	p.observer = observer
+}
+
+// PendingTasks returns the number of tasks waiting in both lanes.
+func (p *uringPoller) PendingTasks() int {
+	return p.urgentQueue.Len() + p.asyncTaskQueue.Len()
+}
+
+// TriggeredTasks returns the number of tasks ever put in both lanes.
+func (p *uringPoller) TriggeredTasks() uint64 {
+	return p.urgentQueue.Total() + p.asyncTaskQueue.Total()
+}
+
+// Trigger wakes up the poller blocked in waiting for network-events and runs jobs in asyncTaskQueue,
+// it fails with errors.ErrAsyncTaskQueueFull if asyncTaskQueue is full.
+func (p *uringPoller) Trigger(task queue.Task) error {
+	if !p.asyncTaskQueue.Enqueue(task) {
+		return errors.ErrAsyncTaskQueueFull
+	}
+	return p.notify()
+}
+
+// UrgentTrigger is Trigger in the high-priority lane, the task is never rejected and runs ahead of all tasks
+// waiting in asyncTaskQueue.
+func (p *uringPoller) UrgentTrigger(task queue.Task) error {
+	p.urgentQueue.Enqueue(task)
+	return p.notify()
+}
+
+// notify writes to the eventfd unless the poller has been woken up and not run the tasks yet,
+// it fails with errors.ErrPollerClosed if the poller has been closed.
+func (p *uringPoller) notify() (err error) {
+	if atomic.LoadInt32(&p.closed) == 1 {
+		return errors.ErrPollerClosed
+	}
+	if atomic.CompareAndSwapInt32(&p.netpollWakeSig, 0, 1) {
+		if !p.enterWake() {
+			return errors.ErrPollerClosed
+		}
+		for _, err = unix.Write(p.wfd, b); err == unix.EINTR || err == unix.EAGAIN; _, err = unix.Write(p.wfd, b) {
+		}
+		p.exitWake()
+	}
+	return os.NewSyscallError("write", err)
+}
+
+// Polling blocks the current goroutine, waiting for network-events.
+func (p *uringPoller) Polling(callback func(fd int, ev uint32) error) error {
+	var wakenUp bool
+	msec := -1
+	for {
+		p.rearm()
+		n, err := p.wait(pollTimeout(p.timer, msec))
+		if n == 0 && (err == nil || err == unix.EINTR || err == unix.EAGAIN || err == unix.EBUSY) {
+			msec = -1
+			if err = expireTimer(p.timer); err != nil {
+				return err
+			}
+			runtime.Gosched()
+			continue
+		} else if n == 0 {
+			logging.DefaultLogger.Warnf("Error occurs in io_uring: %v", os.NewSyscallError("io_uring_enter", err))
+			return err
+		}
+		msec = 0
+		start := time.Now()
+
+		for {
+			cqe, ok := p.reap()
+			if !ok {
+				break
+			}
+			switch cqe.userData &^ (1<<56 - 1) {
+			case uringTimeout:
+				if uint32(cqe.userData) == p.timeoutGen {
+					p.timeoutArmed = false
+				}
+				continue
+			case uringIgnored:
+				continue
+			}
+
+			st, ev := p.complete(cqe)
+			if st == nil {
+				continue
+			}
+			if st.fd == p.wfd {
+				wakenUp = true
+				_, _ = unix.Read(p.wfd, p.wfdBuf)
+				continue
+			}
+			if err = p.handle(callback, st.fd, ev, start); err != nil {
+				return err
+			}
+		}
+
+		// Report the results held by the file-descriptors whose readable events are watched again.
+		for _, st := range p.ready {
+			st.ready = false
+			if st.deleted || st.events&readEvents == 0 {
+				continue
+			}
+			if !st.recvHeld && !st.acceptHeld {
+				continue
+			}
+			p.markDirty(st)
+			if err = p.handle(callback, st.fd, unix.EPOLLIN, start); err != nil {
+				return err
+			}
+		}
+		p.ready = p.ready[:0]
+
+		if wakenUp {
+			wakenUp = false
+			if err = runTasks(p.observer, p.urgentQueue, p.asyncTaskQueue); err != nil {
+				return err
+			}
+			atomic.StoreInt32(&p.netpollWakeSig, 0)
+			if !p.urgentQueue.Empty() || !p.asyncTaskQueue.Empty() {
+				for _, err = unix.Write(p.wfd, b); err == unix.EINTR || err == unix.EAGAIN; _, err = unix.Write(p.wfd, b) {
+				}
+			}
+		}
+
+		p.record(start)
+		if err = expireTimer(p.timer); err != nil {
+			return err
+		}
+	}
+}
+
+// handle runs the callback of the events on fd, it only returns the errors which stop the poller.
+func (p *uringPoller) handle(callback func(fd int, ev uint32) error, fd int, ev uint32, polled time.Time) error {
+	switch err := runCallback(p.observer, callback, fd, ev, polled); err {
+	case nil:
+	case errors.ErrAcceptSocket, errors.ErrServerShutdown:
+		return err
+	default:
+		logging.DefaultLogger.Warnf("Error occurs in event-loop: %v", err)
+	}
+	return nil
+}
+
+// wait submits all queued SQEs and waits for at least one completion up to msec milliseconds,
+// it returns the number of completions and results ready to be handled.
+func (p *uringPoller) wait(msec int) (int, error) {
+	if p.pending() > 0 {
+		msec = 0
+	}
+	var minComplete, flags uint32
+	if msec != 0 {
+		if msec > 0 {
+			if err := p.armTimeout(time.Duration(msec) * time.Millisecond); err != nil {
+				return p.pending(), err
+			}
+		}
+		minComplete, flags = 1, uringEnterGetEvents
+	} else if p.sqPending() == 0 {
+		return p.pending(), nil
+	}
+	err := p.enter(minComplete, flags)
+	return p.pending(), err
+}
+
+func (p *uringPoller) pending() int {
+	return int(p.cqReady()) + len(p.deferred) + len(p.ready)
+}
+
+// enter submits the queued SQEs to the kernel, waiting for minComplete completions if flags say so.
+func (p *uringPoller) enter(minComplete, flags uint32) error {
+	_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER,
+		uintptr(p.fd), uintptr(p.sqPending()), uintptr(minComplete), uintptr(flags), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (p *uringPoller) sqPending() uint32 {
+	return *p.sqTail - atomic.LoadUint32(p.sqHead)
+}
+
+func (p *uringPoller) cqReady() uint32 {
+	return atomic.LoadUint32(p.cqTail) - *p.cqHead
+}
+
+// reap takes the next completion, the deferred ones go first since they have been reaped earlier.
+func (p *uringPoller) reap() (cqe uringCQE, ok bool) {
+	if len(p.deferred) > 0 {
+		cqe = p.deferred[0]
+		p.deferred = p.deferred[1:]
+		return cqe, true
+	}
+	head := *p.cqHead
+	if head == atomic.LoadUint32(p.cqTail) {
+		return cqe, false
+	}
+	cqe = p.cqes[head&p.cqMask]
+	atomic.StoreUint32(p.cqHead, head+1)
+	return cqe, true
+}
+
+// prep queues a SQE, it submits the queued ones first if the submission queue is full.
+func (p *uringPoller) prep(sqe uringSQE) error {
+	if p.sqPending() == p.sqEntries {
+		if err := p.enter(0, 0); err != nil {
+			return os.NewSyscallError("io_uring_enter", err)
+		}
+		if p.sqPending() == p.sqEntries {
+			return os.NewSyscallError("io_uring_enter", unix.EBUSY)
+		}
+	}
+	tail := *p.sqTail
+	p.sqes[tail&p.sqMask] = sqe
+	atomic.StoreUint32(p.sqTail, tail+1)
+	return nil
+}
+
+// armTimeout makes sure that the poller is woken up in d at the latest.
+func (p *uringPoller) armTimeout(d time.Duration) error {
+	at := time.Now().Add(d)
+	if p.timeoutArmed && !p.timeoutAt.After(at) {
+		return nil
+	}
+	if p.timeoutArmed {
+		err := p.prep(uringSQE{
+			opcode: uringOpTimeoutRemove, fd: -1, addr: uringTimeout | uint64(p.timeoutGen), userData: uringIgnored,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	p.timeoutGen++
+	p.ts = uringTimespec{sec: int64(d / time.Second), nsec: int64(d % time.Second)}
+	err := p.prep(uringSQE{
+		opcode:   uringOpTimeout,
+		fd:       -1,
+		addr:     uint64(uintptr(unsafe.Pointer(&p.ts))),
+		len:      1,
+		userData: uringTimeout | uint64(p.timeoutGen),
+	})
+	if err != nil {
+		return err
+	}
+	p.timeoutArmed, p.timeoutAt = true, at
+	return nil
+}
+
+func (p *uringPoller) newRequest(st *uringFdState, op uint8, buf int) *uringRequest {
+	var req *uringRequest
+	if n := len(p.freeReqs); n > 0 {
+		req = p.reqs[p.freeReqs[n-1]]
+		p.freeReqs = p.freeReqs[:n-1]
+	} else {
+		req = &uringRequest{idx: len(p.reqs)}
+		p.reqs = append(p.reqs, req)
+	}
+	req.st, req.op, req.buf, req.off, req.n = st, op, buf, 0, 0
+	return req
+}
+
+func (p *uringPoller) freeRequest(req *uringRequest) {
+	req.st = nil
+	p.freeReqs = append(p.freeReqs, req.idx)
+}
+
+// cancel queues the calling off of the request in flight, whose completion is reaped later as usual.
+func (p *uringPoller) cancel(req *uringRequest) error {
+	op := uint8(uringOpAsyncCancel)
+	if req.op == uringOpPollAdd {
+		op = uringOpPollRemove
+	}
+	return p.prep(uringSQE{opcode: op, fd: -1, addr: req.userData(), userData: uringIgnored})
+}
+
+func (p *uringPoller) prepPoll(st *uringFdState, events uint32) error {
+	req := p.newRequest(st, uringOpPollAdd, -1)
+	if err := p.prep(uringSQE{opcode: uringOpPollAdd, fd: int32(st.fd), opFlags: events, userData: req.userData()}); err != nil {
+		p.freeRequest(req)
+		return err
+	}
+	st.poll, st.pollEvents = req, events
+	return nil
+}
+
+func (p *uringPoller) prepAccept(st *uringFdState) error {
+	req := p.newRequest(st, uringOpAccept, -1)
+	req.sa, req.saLen = unix.RawSockaddrAny{}, unix.SizeofSockaddrAny
+	err := p.prep(uringSQE{
+		opcode:   uringOpAccept,
+		fd:       int32(st.fd),
+		addr:     uint64(uintptr(unsafe.Pointer(&req.sa))),
+		off:      uint64(uintptr(unsafe.Pointer(&req.saLen))),
+		opFlags:  unix.SOCK_NONBLOCK | unix.SOCK_CLOEXEC,
+		userData: req.userData(),
+	})
+	if err != nil {
+		p.freeRequest(req)
+		return err
+	}
+	st.accept = req
+	return nil
+}
+
+func (p *uringPoller) prepRecv(st *uringFdState) error {
+	i := p.recvBufs[len(p.recvBufs)-1]
+	buf := p.buffer(i)
+	req := p.newRequest(st, uringOpReadFixed, i)
+	err := p.prep(uringSQE{
+		opcode:   uringOpReadFixed,
+		fd:       int32(st.fd),
+		addr:     uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		len:      uint32(len(buf)),
+		bufIndex: uint16(i),
+		userData: req.userData(),
+	})
+	if err != nil {
+		p.freeRequest(req)
+		return err
+	}
+	p.recvBufs = p.recvBufs[:len(p.recvBufs)-1]
+	st.recv = req
+	return nil
+}
+
+// prepSend queues the send of the bytes in the registered buffer of request which have not been sent yet.
+func (p *uringPoller) prepSend(req *uringRequest) error {
+	buf := p.buffer(req.buf)[req.off:req.n]
+	return p.prep(uringSQE{
+		opcode:   uringOpWriteFixed,
+		fd:       int32(req.st.fd),
+		addr:     uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		len:      uint32(len(buf)),
+		bufIndex: uint16(req.buf),
+		userData: req.userData(),
+	})
+}
+
+// complete applies the completion of a request to its file-descriptor, it returns the file-descriptor along with
+// the events to report, or nil if there is nothing to report.
+func (p *uringPoller) complete(cqe uringCQE) (*uringFdState, uint32) {
+	req := p.reqs[uint32(cqe.userData)]
+	st := req.st
+	switch req.op {
+	case uringOpPollAdd:
+		p.freeRequest(req)
+		if st.deleted || st.poll != req {
+			// Stale completion of a poll request that has been removed.
+			return nil, 0
+		}
+		st.poll = nil
+		p.markDirty(st)
+		if cqe.res < 0 {
+			return st, unix.EPOLLERR
+		}
+		return st, uint32(cqe.res)
+	case uringOpReadFixed:
+		if st.deleted || st.recv != req {
+			p.recvBufs = append(p.recvBufs, req.buf)
+			p.freeRequest(req)
+			return nil, 0
+		}
+		p.holdRecv(req, cqe.res)
+		p.markDirty(st)
+		// The data received while reading is paused are held until it's resumed.
+		if !st.recvHeld || st.events&readEvents == 0 {
+			return nil, 0
+		}
+		return st, unix.EPOLLIN
+	case uringOpWriteFixed:
+		if st.deleted || st.send != req {
+			p.sendBufs = append(p.sendBufs, req.buf)
+			p.freeRequest(req)
+			return nil, 0
+		}
+		if !p.holdSent(req, cqe.res, true) {
+			return nil, 0
+		}
+		p.markDirty(st)
+		if !st.sentHeld {
+			return nil, 0
+		}
+		return st, unix.EPOLLOUT
+	case uringOpAccept:
+		if st.deleted || st.accept != req {
+			p.freeRequest(req)
+			if cqe.res >= 0 {
+				_ = unix.Close(int(cqe.res))
+			}
+			return nil, 0
+		}
+		p.holdAccept(req, cqe.res)
+		p.markDirty(st)
+		if !st.acceptHeld {
+			return nil, 0
+		}
+		return st, unix.EPOLLIN
+	}
+	return nil, 0
+}
+
+// holdAccept holds the connection accepted by the request in flight until it's taken.
+func (p *uringPoller) holdAccept(req *uringRequest, res int32) {
+	st := req.st
+	st.accept = nil
+	if errno := unix.Errno(-res); res >= 0 || errno != unix.ECANCELED && errno != unix.EINTR && errno != unix.EAGAIN {
+		st.acceptHeld, st.acceptRes, st.acceptSa = true, res, nil
+		if res >= 0 {
+			st.acceptSa = sockaddrFromRaw(&req.sa)
+		}
+	}
+	p.freeRequest(req)
+}
+
+// holdRecv holds the result of the receive in flight until it's taken, the data received stay in its buffer.
+func (p *uringPoller) holdRecv(req *uringRequest, res int32) {
+	st := req.st
+	st.recv = nil
+	buf := req.buf
+	p.freeRequest(req)
+	if res > 0 {
+		st.recvHeld, st.recvRes, st.recvBuf = true, res, buf
+		return
+	}
+	p.recvBufs = append(p.recvBufs, buf)
+	if errno := unix.Errno(-res); errno != unix.ECANCELED && errno != unix.EINTR && errno != unix.EAGAIN {
+		// The end of stream or an error.
+		st.recvHeld, st.recvRes = true, res
+	}
+}
+
+// holdSent holds the result of the send in flight until it's taken. After a short write, the rest of data are sent
+// again if resend is true, in which case it reports false.
+func (p *uringPoller) holdSent(req *uringRequest, res int32, resend bool) bool {
+	if res > 0 {
+		req.off += int(res)
+		if resend && req.off < req.n && p.prepSend(req) == nil {
+			return false
+		}
+	}
+	st := req.st
+	st.send = nil
+	switch {
+	case req.off > 0:
+		// The error after a short write occurs again on the next send.
+		st.sentHeld, st.sentRes = true, int32(req.off)
+	case res < 0 && unix.Errno(-res) != unix.ECANCELED:
+		st.sentHeld, st.sentRes = true, res
+	}
+	p.sendBufs = append(p.sendBufs, req.buf)
+	p.freeRequest(req)
+	return true
+}
+
+// settle calls off the receive in flight of the file-descriptor, and the send and accept as well if all is true,
+// and waits for them to complete, so that their results are held. The completions of the other requests reaped in
+// the meantime are deferred to Polling.
+func (p *uringPoller) settle(st *uringFdState, all bool) error {
+	reqs := []*uringRequest{st.recv}
+	if all {
+		reqs = append(reqs, st.send, st.accept)
+	}
+	for _, req := range reqs {
+		if req == nil {
+			continue
+		}
+		if err := p.cancel(req); err != nil {
+			return err
+		}
+	}
+	// The completions may have been reaped already while settling another file-descriptor.
+	deferred := p.deferred[:0]
+	for _, cqe := range p.deferred {
+		if !p.settled(st, all, cqe) {
+			deferred = append(deferred, cqe)
+		}
+	}
+	p.deferred = deferred
+	for st.recv != nil || all && (st.send != nil || st.accept != nil) {
+		if err := p.enter(1, uringEnterGetEvents); err != nil && err != unix.EINTR {
+			return os.NewSyscallError("io_uring_enter", err)
+		}
+		for head, tail := *p.cqHead, atomic.LoadUint32(p.cqTail); head != tail; head++ {
+			cqe := p.cqes[head&p.cqMask]
+			atomic.StoreUint32(p.cqHead, head+1)
+			if !p.settled(st, all, cqe) {
+				p.deferred = append(p.deferred, cqe)
+			}
+		}
+	}
+	return nil
+}
+
+// settled applies the completion if it's of a request being settled, it reports whether it is.
+func (p *uringPoller) settled(st *uringFdState, all bool, cqe uringCQE) bool {
+	if cqe.userData&^(1<<56-1) != uringRequestData {
+		return false
+	}
+	switch req := p.reqs[uint32(cqe.userData)]; {
+	case req == st.recv:
+		p.holdRecv(req, cqe.res)
+	case all && req == st.send:
+		p.holdSent(req, cqe.res, false)
+	case all && req == st.accept:
+		p.holdAccept(req, cqe.res)
+	default:
+		return false
+	}
+	return true
+}
+
+func (p *uringPoller) markDirty(st *uringFdState) {
+	if !st.dirty {
+		st.dirty = true
+		p.dirty = append(p.dirty, st)
+	}
+}
+
+// rearm frees the buffers of the data taken and brings the requests of the file-descriptors changed since
+// the last time in line with their events of interest.
+func (p *uringPoller) rearm() {
+	p.recvBufs = append(p.recvBufs, p.spent...)
+	p.spent = p.spent[:0]
+	for _, st := range p.dirty {
+		st.dirty = false
+		if st.deleted {
+			continue
+		}
+		if err := p.arm(st); err != nil {
+			logging.DefaultLogger.Warnf("Error occurs in io_uring: %v", err)
+		}
+	}
+	p.dirty = p.dirty[:0]
+}
+
+// arm brings the requests in flight of the file-descriptor in line with its events of interest.
+func (p *uringPoller) arm(st *uringFdState) error {
+	in := st.events&readEvents != 0
+	// The writable events are reported by the completion of the send in flight.
+	out := st.events&writeEvents != 0 && st.send == nil && !st.sentHeld
+	switch st.kind {
+	case uringAcceptor:
+		if in && st.accept == nil && !st.acceptHeld {
+			if err := p.prepAccept(st); err != nil {
+				return err
+			}
+		}
+		in = in && st.accept == nil && !st.acceptHeld
+	case uringStream:
+		// A receive is not started while the writable events are watched, which is also the case of a socket
+		// being connected, the poll request watches both.
+		if in && !out && st.recv == nil && !st.recvHeld && len(p.recvBufs) > 0 {
+			if err := p.prepRecv(st); err != nil {
+				return err
+			}
+		}
+		in = in && st.recv == nil && !st.recvHeld
+	}
+	if (st.recvHeld || st.acceptHeld) && st.events&readEvents != 0 && !st.ready {
+		st.ready = true
+		p.ready = append(p.ready, st)
+	}
+
+	var events uint32
+	if in {
+		events |= readEvents
+	}
+	if out {
+		events |= writeEvents
+	}
+	// Errors and hang-ups are watched by a poll request unless there is another request in flight.
+	polled := events != 0 || st.recv == nil && st.send == nil && st.accept == nil
+	if st.poll != nil && (!polled || st.pollEvents != events) {
+		if err := p.cancel(st.poll); err != nil {
+			return err
+		}
+		st.poll = nil
+	}
+	if polled && st.poll == nil {
+		return p.prepPoll(st, events)
+	}
+	return nil
+}
+
+func (p *uringPoller) add(fd int, events uint32, kind int) error {
+	if _, ok := p.fds[fd]; ok {
+		return os.NewSyscallError("io_uring poll add", unix.EEXIST)
+	}
+	if old, ok := p.detached[fd]; ok {
+		// The file-descriptor of a deleted listener has been reused, the connection it accepted is abandoned.
+		delete(p.detached, fd)
+		if old.acceptRes >= 0 {
+			_ = unix.Close(int(old.acceptRes))
+		}
+	}
+	if !p.completes {
+		kind = uringPolled
+	}
+	st := &uringFdState{fd: fd, kind: kind, events: events, recvBuf: -1}
+	p.fds[fd] = st
+	p.markDirty(st)
+	return nil
+}
+
+func (p *uringPoller) mod(fd int, events uint32) error {
+	st, ok := p.fds[fd]
+	if !ok {
+		return os.NewSyscallError("io_uring poll mod", unix.ENOENT)
+	}
+	if st.events != events {
+		st.events = events
+		p.markDirty(st)
+	}
+	return nil
+}
+
+// AddReadWrite registers the given file-descriptor with readable and writable events to the poller.
+func (p *uringPoller) AddReadWrite(fd int) error {
+	return p.add(fd, readWriteEvents, uringPolled)
+}
+
+// AddRead registers the given file-descriptor with readable event to the poller.
+func (p *uringPoller) AddRead(fd int) error {
+	return p.add(fd, readEvents, uringPolled)
+}
+
+// AddWrite registers the given file-descriptor with writable event to the poller.
+func (p *uringPoller) AddWrite(fd int) error {
+	return p.add(fd, writeEvents, uringPolled)
+}
+
+// AddReadWriteET is not supported since poll requests of io_uring are level-triggered.
+func (p *uringPoller) AddReadWriteET(_ int) error {
+	return errors.ErrUnsupportedOp
+}
+
+// ModRead renews the given file-descriptor with readable event in the poller.
+func (p *uringPoller) ModRead(fd int) error {
+	return p.mod(fd, readEvents)
+}
+
+// ModReadWrite renews the given file-descriptor with readable and writable events in the poller.
+func (p *uringPoller) ModReadWrite(fd int) error {
+	return p.mod(fd, readWriteEvents)
+}
+
+// ModWrite renews the given file-descriptor with writable event in the poller.
+func (p *uringPoller) ModWrite(fd int) error {
+	return p.mod(fd, writeEvents)
+}
+
+// ModNone renews the given file-descriptor without readable and writable events in the poller,
+// only the errors and hang-ups of it are reported then.
+func (p *uringPoller) ModNone(fd int) error {
+	return p.mod(fd, 0)
+}
+
+// Delete removes the given file-descriptor from the poller.
+func (p *uringPoller) Delete(fd int) error {
+	_, _, err := p.Detach(fd)
+	return err
+}
+
+// AddAcceptor registers the listener whose connections are accepted by the poller.
+func (p *uringPoller) AddAcceptor(fd int) error {
+	return p.add(fd, readEvents, uringAcceptor)
+}
+
+// AddStream registers the connected stream socket which is received from and sent to by the poller.
+func (p *uringPoller) AddStream(fd int, write bool) error {
+	if write {
+		return p.add(fd, readWriteEvents, uringStream)
+	}
+	return p.add(fd, readEvents, uringStream)
+}
+
+// Accepted returns the connection accepted from the listener by the poller, it accepts one in place if there is none.
+// The connection accepted by a listener is kept after it has been deleted until it's taken, so that it's not lost
+// when the accept queue is handed over.
+func (p *uringPoller) Accepted(fd int) (int, unix.Sockaddr, error) {
+	st, ok := p.fds[fd]
+	if !ok {
+		st, ok = p.detached[fd]
+		delete(p.detached, fd)
+	}
+	if ok && st.acceptHeld {
+		st.acceptHeld = false
+		p.markDirty(st)
+		if st.acceptRes < 0 {
+			return -1, nil, unix.Errno(-st.acceptRes)
+		}
+		return int(st.acceptRes), st.acceptSa, nil
+	}
+	return unix.Accept4(fd, unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+}
+
+// Recv returns the data received from the stream by the poller, which are valid until the poller goes on waiting.
+// The receive in flight is called off to take the data that have arrived, it reads into buf in place if there are
+// none.
+func (p *uringPoller) Recv(fd int, buf []byte) ([]byte, error) {
+	if st, ok := p.fds[fd]; ok {
+		if st.recv != nil {
+			if err := p.settle(st, false); err != nil {
+				return nil, err
+			}
+			p.markDirty(st)
+		}
+		if st.recvHeld {
+			st.recvHeld = false
+			p.markDirty(st)
+			if st.recvRes == 0 {
+				return nil, nil
+			} else if st.recvRes < 0 {
+				return nil, unix.Errno(-st.recvRes)
+			}
+			p.spent = append(p.spent, st.recvBuf)
+			data := p.buffer(st.recvBuf)[:st.recvRes]
+			st.recvBuf = -1
+			return data, nil
+		}
+	}
+	n, err := unix.Read(fd, buf)
+	if n < 0 {
+		n = 0
+	}
+	return buf[:n], err
+}
+
+// Send copies as many bytes of head and tail as a registered buffer holds, and sends them in background.
+// It reports false if there is no registered buffer left.
+func (p *uringPoller) Send(fd int, head, tail []byte) bool {
+	st, ok := p.fds[fd]
+	if !ok || st.kind != uringStream || st.send != nil || st.sentHeld || len(p.sendBufs) == 0 {
+		return false
+	}
+	i := p.sendBufs[len(p.sendBufs)-1]
+	buf := p.buffer(i)
+	n := copy(buf, head)
+	n += copy(buf[n:], tail)
+	if n == 0 {
+		return false
+	}
+	req := p.newRequest(st, uringOpWriteFixed, i)
+	req.n = n
+	if err := p.prepSend(req); err != nil {
+		p.freeRequest(req)
+		return false
+	}
+	p.sendBufs = p.sendBufs[:len(p.sendBufs)-1]
+	st.send = req
+	p.markDirty(st)
+	return true
+}
+
+// Sent takes the number of bytes sent by the completed send, it fails with unix.EAGAIN while the send is in flight.
+func (p *uringPoller) Sent(fd int) (int, error) {
+	st, ok := p.fds[fd]
+	switch {
+	case !ok:
+		return 0, nil
+	case st.send != nil:
+		return 0, unix.EAGAIN
+	case !st.sentHeld:
+		return 0, nil
+	}
+	st.sentHeld = false
+	p.markDirty(st)
+	if st.sentRes < 0 {
+		return 0, unix.Errno(-st.sentRes)
+	}
+	return int(st.sentRes), nil
+}
+
+// Detach removes the given file-descriptor from the poller, it waits for the requests in flight to be called off
+// and returns the data received and the number of bytes sent by them. The data are valid until the poller goes
+// on waiting.
+func (p *uringPoller) Detach(fd int) (received []byte, sent int, err error) {
+	st, ok := p.fds[fd]
+	if !ok {
+		return nil, 0, os.NewSyscallError("io_uring poll remove", unix.ENOENT)
+	}
+	delete(p.fds, fd)
+	st.deleted = true
+	if st.poll != nil {
+		if err = p.cancel(st.poll); err != nil {
+			return
+		}
+		st.poll = nil
+	}
+	if err = p.settle(st, true); err != nil {
+		return
+	}
+	if st.acceptHeld {
+		p.detached[fd] = st
+	}
+	if st.recvHeld && st.recvRes > 0 {
+		p.spent = append(p.spent, st.recvBuf)
+		received = p.buffer(st.recvBuf)[:st.recvRes]
+	}
+	if st.sentHeld && st.sentRes > 0 {
+		sent = int(st.sentRes)
+	}
+	return
+}
+
+// sockaddrFromRaw converts the address of the peer of a connection accepted by the poller, like unix.Accept4 does.
+func sockaddrFromRaw(rsa *unix.RawSockaddrAny) unix.Sockaddr {
+	switch rsa.Addr.Family {
+	case unix.AF_INET:
+		pp := (*unix.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		port := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		return &unix.SockaddrInet4{Port: int(port[0])<<8 + int(port[1]), Addr: pp.Addr}
+	case unix.AF_INET6:
+		pp := (*unix.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		port := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		return &unix.SockaddrInet6{Port: int(port[0])<<8 + int(port[1]), ZoneId: pp.Scope_id, Addr: pp.Addr}
+	case unix.AF_UNIX:
+		pp := (*unix.RawSockaddrUnix)(unsafe.Pointer(rsa))
+		if pp.Path[0] == 0 {
+			// Abstract or unnamed socket, the leading NUL is rewritten as @ by convention.
+			pp.Path[0] = '@'
+		}
+		n := 0
+		for n < len(pp.Path) && pp.Path[n] != 0 {
+			n++
+		}
+		name := make([]byte, n)
+		for i := range name {
+			name[i] = byte(pp.Path[i])
+		}
+		return &unix.SockaddrUnix{Name: string(name)}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// +build linux
+
+package netpoll
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"shpnetpoll/errors"
+)
+
+// pollForTest runs the poller until the callback reports that it's done with the event, or fails after 5 seconds.
+func pollForTest(t *testing.T, p Poller, done func(fd int, ev uint32) bool) {
+	timeout := time.AfterFunc(5*time.Second, func() {
+		_ = p.UrgentTrigger(func() error { return errors.ErrServerShutdown })
+	})
+	defer timeout.Stop()
+	var ok bool
+	_ = p.Polling(func(fd int, ev uint32) error {
+		if ok = done(fd, ev); ok {
+			return errors.ErrServerShutdown
+		}
+		return nil
+	})
+	if !ok {
+		t.Fatal("expect the event to be reported in 5 seconds")
+	}
+}
+
+// fdForTest returns a non-blocking duplicate of the fd of the file.
+func fdForTest(t *testing.T, f interface{ File() (*os.File, error) }) int {
+	file, err := f.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	fd, err := unix.Dup(int(file.Fd()))
+	if err == nil {
+		err = unix.SetNonblock(fd, true)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+func TestIOUringCompletions(t *testing.T) {
+	p, err := openIOUringPoller(0, 4096)
+	if err != nil {
+		t.Skipf("io_uring is not available: %v", err)
+	}
+	defer p.Close()
+	if !p.completes || p.bufMem == nil {
+		t.Skip("io_uring doesn't complete accepts, receives and sends on this kernel")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	lfd := fdForTest(t, ln.(*net.TCPListener))
+	defer unix.Close(lfd)
+	if err = p.AddAcceptor(lfd); err != nil {
+		t.Fatal(err)
+	}
+	cli, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	// The connection is accepted by the poller.
+	pollForTest(t, p, func(fd int, ev uint32) bool { return fd == lfd && ev&InEvents != 0 })
+	nfd, sa, err := p.Accepted(lfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(nfd)
+	if sa4, ok := sa.(*unix.SockaddrInet4); !ok || sa4.Port != cli.LocalAddr().(*net.TCPAddr).Port {
+		t.Fatalf("expect the address of %s but got %#v", cli.LocalAddr(), sa)
+	}
+
+	// The data are received by the poller.
+	if err = p.AddStream(nfd, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	pollForTest(t, p, func(fd int, ev uint32) bool { return fd == nfd && ev&InEvents != 0 })
+	if data, err := p.Recv(nfd, nil); string(data) != "hello" || err != nil {
+		t.Fatalf("expect hello to be received but got %q: %v", data, err)
+	}
+
+	// Both parts are sent by the poller in one request.
+	if !p.Send(nfd, []byte("wor"), []byte("ld")) {
+		t.Fatal("expect the data to be taken for sending")
+	}
+	if _, err = p.Sent(nfd); err != unix.EAGAIN {
+		t.Fatalf("expect EAGAIN while the send is in flight but got %v", err)
+	}
+	pollForTest(t, p, func(fd int, ev uint32) bool { return fd == nfd && ev&OutEvents != 0 })
+	if n, err := p.Sent(nfd); n != 5 || err != nil {
+		t.Fatalf("expect 5 bytes to be sent but got %d: %v", n, err)
+	}
+	got := make([]byte, 5)
+	_ = cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = cli.Read(got); string(got) != "world" || err != nil {
+		t.Fatalf("expect world to be sent but got %q: %v", got, err)
+	}
+
+	// The data received by the request in flight are handed over by Detach.
+	if _, err = cli.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if data, sent, err := p.Detach(nfd); string(data) != "bye" || sent != 0 || err != nil {
+		t.Fatalf("expect bye to be handed over but got %q and %d bytes sent: %v", data, sent, err)
+	}
+}
@@ -0,0 +1,275 @@
+// +build linux
+
+package netpoll
+
+import (
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"shpnetpoll/errors"
+	"shpnetpoll/internal/logging"
+	"shpnetpoll/internal/netpoll/queue"
+)
+
+// pollPoller is the Poller built on top of poll(2) and a self-pipe, it works in the sandboxes where
+// epoll or eventfd is not allowed, at the cost of passing all the file-descriptors to the kernel on every wait.
+type pollPoller struct {
+	latency                      // kept first for 64-bit alignment
+	rfd            int           // read end of the self-pipe
+	wfd            int           // write end of the self-pipe
+	wfdBuf         []byte        // buffer to drain the self-pipe
+	fds            []unix.PollFd // file-descriptors being watched
+	index          map[int]int   // position of every file-descriptor in fds
+	ready          []unix.PollFd // file-descriptors reported in the current iteration
+	netpollWakeSig int32
+	asyncTaskQueue queue.AsyncTaskQueue
+	urgentQueue    queue.AsyncTaskQueue
+	wakeGuard
+	timer    Timer    // timer driven by the timeout of poll
+	observer Observer // observer of handling network-events and tasks, nil if there is none
+}
+
+// OpenPollPoller instantiates a poll-based poller, the normal lane of asynchronous tasks holds up to
+// taskQueueCap tasks, or is unbounded if taskQueueCap is not positive.
+func OpenPollPoller(taskQueueCap int) (Poller, error) {
+	p, err := openPollPoller(taskQueueCap)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func openPollPoller(taskQueueCap int) (poller *pollPoller, err error) {
+	var fds [2]int
+	if err = unix.Pipe2(fds[:], unix.O_NONBLOCK|unix.O_CLOEXEC); err != nil {
+		return nil, os.NewSyscallError("pipe2", err)
+	}
+	poller = &pollPoller{rfd: fds[0], wfd: fds[1], index: make(map[int]int)}
+	poller.wfdBuf = make([]byte, 64)
+	if err = poller.AddRead(poller.rfd); err != nil {
+		_ = poller.Close()
+		return nil, err
+	}
+	poller.asyncTaskQueue = newTaskQueue(taskQueueCap)
+	poller.urgentQueue = queue.NewLockFreeQueue()
+	return
+}
+
+// Close closes the poller.
+func (p *pollPoller) Close() error {
+	p.shut()
+	if err := os.NewSyscallError("close", unix.Close(p.rfd)); err != nil {
+		return err
+	}
+	return os.NewSyscallError("close", unix.Close(p.wfd))
+}
+
+// SetTimer sets up the timer to be driven by the poller, it must be called before Polling.
+func (p *pollPoller) SetTimer(timer Timer) {
+	p.timer = timer
+}
+
+// SetObserver sets up the observer of handling network-events and tasks, it must be called before Polling.
+func (p *pollPoller) SetObserver(observer Observer) {
+	p.observer = observer
+}
+
+// wake writes one byte into the self-pipe, a full pipe means that the poller is about to wake up anyway.
+func (p *pollPoller) wake() (err error) {
+	for _, err = unix.Write(p.wfd, b[:1]); err == unix.EINTR; _, err = unix.Write(p.wfd, b[:1]) {
+	}
+	if err == unix.EAGAIN {
+		err = nil
+	}
+	return os.NewSyscallError("write", err)
+}
+
+// PendingTasks returns the number of tasks waiting in both lanes.
+func (p *pollPoller) PendingTasks() int {
+	return p.urgentQueue.Len() + p.asyncTaskQueue.Len()
+}
+
+// TriggeredTasks returns the number of tasks ever put in both lanes.
+func (p *pollPoller) TriggeredTasks() uint64 {
+	return p.urgentQueue.Total() + p.asyncTaskQueue.Total()
+}
+
+// Trigger wakes up the poller blocked in waiting for network-events and runs jobs in asyncTaskQueue,
+// it fails with errors.ErrAsyncTaskQueueFull if asyncTaskQueue is full.
+func (p *pollPoller) Trigger(task queue.Task) error {
+	if !p.asyncTaskQueue.Enqueue(task) {
+		return errors.ErrAsyncTaskQueueFull
+	}
+	return p.notify()
+}
+
+// UrgentTrigger is Trigger in the high-priority lane, the task is never rejected and runs ahead of all tasks
+// waiting in asyncTaskQueue.
+func (p *pollPoller) UrgentTrigger(task queue.Task) error {
+	p.urgentQueue.Enqueue(task)
+	return p.notify()
+}
+
+// notify wakes up the poller unless it has been woken up and not run the tasks yet,
+// it fails with errors.ErrPollerClosed if the poller has been closed.
+func (p *pollPoller) notify() (err error) {
+	if atomic.LoadInt32(&p.closed) == 1 {
+		return errors.ErrPollerClosed
+	}
+	if atomic.CompareAndSwapInt32(&p.netpollWakeSig, 0, 1) {
+		if !p.enterWake() {
+			return errors.ErrPollerClosed
+		}
+		err = p.wake()
+		p.exitWake()
+	}
+	return
+}
+
+// Polling blocks the current goroutine, waiting for network-events.
+func (p *pollPoller) Polling(callback func(fd int, ev uint32) error) error {
+	var wakenUp bool
+	msec := -1
+	for {
+		n, err := unix.Poll(p.fds, pollTimeout(p.timer, msec))
+		if n == 0 || (n < 0 && err == unix.EINTR) {
+			msec = -1
+			if err = expireTimer(p.timer); err != nil {
+				return err
+			}
+			runtime.Gosched()
+			continue
+		} else if err != nil {
+			logging.DefaultLogger.Warnf("Error occurs in poll: %v", os.NewSyscallError("poll", err))
+			return err
+		}
+		msec = 0
+		start := time.Now()
+
+		// Collect the reported file-descriptors first since callbacks may add or delete some of them.
+		p.ready = p.ready[:0]
+		for i := range p.fds {
+			if p.fds[i].Revents != 0 {
+				p.ready = append(p.ready, p.fds[i])
+				p.fds[i].Revents = 0
+			}
+		}
+
+		for _, pfd := range p.ready {
+			ev := uint32(uint16(pfd.Revents))
+			if ev&unix.POLLNVAL != 0 {
+				ev = unix.EPOLLERR
+			}
+			if fd := int(pfd.Fd); fd != p.rfd {
+				switch err = runCallback(p.observer, callback, fd, ev, start); err {
+				case nil:
+				case errors.ErrAcceptSocket, errors.ErrServerShutdown:
+					return err
+				default:
+					logging.DefaultLogger.Warnf("Error occurs in event-loop: %v", err)
+				}
+			} else {
+				wakenUp = true
+				for {
+					if n, err := unix.Read(p.rfd, p.wfdBuf); n < len(p.wfdBuf) && err != unix.EINTR {
+						break
+					}
+				}
+			}
+		}
+
+		if wakenUp {
+			wakenUp = false
+			if err = runTasks(p.observer, p.urgentQueue, p.asyncTaskQueue); err != nil {
+				return err
+			}
+			atomic.StoreInt32(&p.netpollWakeSig, 0)
+			if !p.urgentQueue.Empty() || !p.asyncTaskQueue.Empty() {
+				_ = p.wake()
+			}
+		}
+
+		p.record(start)
+		if err = expireTimer(p.timer); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *pollPoller) add(fd int, events int16) error {
+	if _, ok := p.index[fd]; ok {
+		return os.NewSyscallError("poll add", unix.EEXIST)
+	}
+	p.index[fd] = len(p.fds)
+	p.fds = append(p.fds, unix.PollFd{Fd: int32(fd), Events: events})
+	return nil
+}
+
+func (p *pollPoller) mod(fd int, events int16) error {
+	i, ok := p.index[fd]
+	if !ok {
+		return os.NewSyscallError("poll mod", unix.ENOENT)
+	}
+	p.fds[i].Events = events
+	return nil
+}
+
+// AddReadWrite registers the given file-descriptor with readable and writable events to the poller.
+func (p *pollPoller) AddReadWrite(fd int) error {
+	return p.add(fd, readWriteEvents)
+}
+
+// AddRead registers the given file-descriptor with readable event to the poller.
+func (p *pollPoller) AddRead(fd int) error {
+	return p.add(fd, readEvents)
+}
+
+// AddWrite registers the given file-descriptor with writable event to the poller.
+func (p *pollPoller) AddWrite(fd int) error {
+	return p.add(fd, writeEvents)
+}
+
+// AddReadWriteET is not supported since poll(2) is level-triggered.
+func (p *pollPoller) AddReadWriteET(_ int) error {
+	return errors.ErrUnsupportedOp
+}
+
+// ModRead renews the given file-descriptor with readable event in the poller.
+func (p *pollPoller) ModRead(fd int) error {
+	return p.mod(fd, readEvents)
+}
+
+// ModReadWrite renews the given file-descriptor with readable and writable events in the poller.
+func (p *pollPoller) ModReadWrite(fd int) error {
+	return p.mod(fd, readWriteEvents)
+}
+
+// ModWrite renews the given file-descriptor with writable event in the poller.
+func (p *pollPoller) ModWrite(fd int) error {
+	return p.mod(fd, writeEvents)
+}
+
+// ModNone renews the given file-descriptor without readable and writable events in the poller,
+// only the errors and hang-ups of it are reported then.
+func (p *pollPoller) ModNone(fd int) error {
+	return p.mod(fd, 0)
+}
+
+// Delete removes the given file-descriptor from the poller.
+func (p *pollPoller) Delete(fd int) error {
+	i, ok := p.index[fd]
+	if !ok {
+		return os.NewSyscallError("poll delete", unix.ENOENT)
+	}
+	last := len(p.fds) - 1
+	if i != last {
+		p.fds[i] = p.fds[last]
+		p.index[int(p.fds[i].Fd)] = i
+	}
+	p.fds = p.fds[:last]
+	delete(p.index, fd)
+	return nil
+}
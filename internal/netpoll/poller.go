@@ -0,0 +1,261 @@
+// +build linux
+
+package netpoll
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"shpnetpoll/errors"
+	"shpnetpoll/internal/logging"
+	"shpnetpoll/internal/netpoll/queue"
+)
+
+// Poller represents a poller which is in charge of monitoring file-descriptors.
+//
+// Events are reported to the callback of Polling with the epoll flags (InEvents, OutEvents and ErrEvents),
+// whatever the mechanism underneath is.
+type Poller interface {
+	// Close closes the poller.
+	Close() error
+	// Trigger wakes up the poller blocked in waiting for network-events and runs jobs in asyncTaskQueue,
+	// it fails with errors.ErrAsyncTaskQueueFull if asyncTaskQueue is bounded and full, or errors.ErrPollerClosed
+	// if the poller has been closed.
+	Trigger(task queue.Task) error
+	// UrgentTrigger is Trigger in the high-priority lane, the task is never rejected and runs ahead of all tasks
+	// waiting in asyncTaskQueue.
+	UrgentTrigger(task queue.Task) error
+	// Polling blocks the current goroutine, waiting for network-events.
+	Polling(callback func(fd int, ev uint32) error) error
+	// SetTimer sets up the timer to be driven by the poller, it must be called before Polling.
+	SetTimer(timer Timer)
+	// SetObserver sets up the observer of handling network-events and tasks, it must be called before Polling.
+	SetObserver(observer Observer)
+	// AddRead registers the given file-descriptor with readable event to the poller.
+	AddRead(fd int) error
+	// AddWrite registers the given file-descriptor with writable event to the poller.
+	AddWrite(fd int) error
+	// AddReadWrite registers the given file-descriptor with readable and writable events to the poller.
+	AddReadWrite(fd int) error
+	// AddReadWriteET registers the given file-descriptor with edge-triggered readable and writable events
+	// to the poller, it fails with ErrUnsupportedOp if the poller can't trigger on edges.
+	AddReadWriteET(fd int) error
+	// ModRead renews the given file-descriptor with readable event in the poller.
+	ModRead(fd int) error
+	// ModReadWrite renews the given file-descriptor with readable and writable events in the poller.
+	ModReadWrite(fd int) error
+	// ModWrite renews the given file-descriptor with writable event in the poller.
+	ModWrite(fd int) error
+	// ModNone renews the given file-descriptor without readable and writable events in the poller,
+	// only the errors and hang-ups of it are reported then.
+	ModNone(fd int) error
+	// Delete removes the given file-descriptor from the poller.
+	Delete(fd int) error
+	// PendingTasks returns the number of tasks waiting in both lanes, it is safe to be called from any goroutine.
+	PendingTasks() int
+	// TriggeredTasks returns the number of tasks ever triggered, it is safe to be called from any goroutine.
+	TriggeredTasks() uint64
+	// Latency returns the smoothed duration spent on handling the events of recent iterations, which decays while
+	// the poller is idle, it is safe to be called from any goroutine.
+	Latency() time.Duration
+}
+
+// Completer is a Poller which accepts, receives and sends on behalf of the event-loop, like io_uring does, and reports
+// their completions to the callback of Polling as the readable and writable events of file-descriptors. Only the
+// file-descriptors registered by AddAcceptor and AddStream are completed, the others are merely polled.
+type Completer interface {
+	Poller
+	// AddAcceptor registers the listener whose connections are accepted by the poller.
+	AddAcceptor(fd int) error
+	// AddStream registers the connected stream socket which is received from and sent to by the poller,
+	// with writable event as well if write is true.
+	AddStream(fd int, write bool) error
+	// Accepted returns the connection accepted from the listener by the poller, it accepts one in place if
+	// there is none.
+	Accepted(fd int) (nfd int, sa unix.Sockaddr, err error)
+	// Recv returns the data received from the stream by the poller, which are valid until the poller goes on waiting,
+	// it reads into buf in place if there are none. An empty result without error is the end of stream.
+	Recv(fd int, buf []byte) ([]byte, error)
+	// Send copies as many bytes of head and tail as it can take, and sends them in background. It reports false if
+	// the poller can't take them, in which case the caller writes them in place.
+	Send(fd int, head, tail []byte) bool
+	// Sent takes the number of bytes sent by the last Send, it fails with unix.EAGAIN while the send is in flight.
+	Sent(fd int) (int, error)
+	// Detach is Delete that also returns the data received and the number of bytes sent by the requests in flight,
+	// which are called off, the data are valid until the poller goes on waiting.
+	Detach(fd int) (received []byte, sent int, err error)
+}
+
+// Timer represents the time-based jobs which are run by the poller between network-events.
+type Timer interface {
+	// Timeout returns the duration until the next job is due, a negative value means that there is no job.
+	Timeout() time.Duration
+	// Expire runs all jobs that are due.
+	Expire() error
+}
+
+// Observer watches the poller handling network-events and running tasks in Polling, every BeginEvent or BeginTask
+// is followed by End once the callback or the task returns.
+type Observer interface {
+	// BeginEvent is called before the callback of the network-event on fd, polled is when the poller returned
+	// from waiting for it.
+	BeginEvent(fd int, polled time.Time)
+	// BeginTask is called before running a task in asyncTaskQueue.
+	BeginTask()
+	// End is called after the callback or the task returns.
+	End()
+}
+
+// runCallback runs the callback of the network-event on fd, watched by the observer if there is one.
+func runCallback(o Observer, callback func(fd int, ev uint32) error, fd int, ev uint32, polled time.Time) error {
+	if o == nil {
+		return callback(fd, ev)
+	}
+	o.BeginEvent(fd, polled)
+	err := callback(fd, ev)
+	o.End()
+	return err
+}
+
+// runTask runs the task, watched by the observer if there is one.
+func runTask(o Observer, task queue.Task) error {
+	if o == nil {
+		return task()
+	}
+	o.BeginTask()
+	err := task()
+	o.End()
+	return err
+}
+
+// newTaskQueue instantiates the queue of the normal lane, which holds up to capacity tasks,
+// or is unbounded if capacity is not positive.
+func newTaskQueue(capacity int) queue.AsyncTaskQueue {
+	if capacity > 0 {
+		return queue.NewBoundedQueue(capacity)
+	}
+	return queue.NewLockFreeQueue()
+}
+
+// runTasks runs up to AsyncTasks tasks in the normal lane, a task in the normal lane never runs while there are
+// tasks waiting in the high-priority lane, which are all run first.
+func runTasks(o Observer, urgent, tasks queue.AsyncTaskQueue) error {
+	for n := 0; ; {
+		task := urgent.Dequeue()
+		if task == nil {
+			if n == AsyncTasks {
+				return nil
+			}
+			if task = tasks.Dequeue(); task == nil {
+				return nil
+			}
+			n++
+		}
+		switch err := runTask(o, task); err {
+		case nil:
+		case errors.ErrServerShutdown:
+			return err
+		default:
+			logging.DefaultLogger.Warnf("Error occurs in user-defined function, %v", err)
+		}
+	}
+}
+
+// wakeGuard keeps the wake fd of a poller from being written once the poller has been closed, by when the number of
+// the fd may have been reused by another file, it is embedded by pollers.
+type wakeGuard struct {
+	mu     sync.RWMutex
+	closed int32
+}
+
+// enterWake reports whether the wake fd can be written, in which case exitWake must be called after the write.
+func (g *wakeGuard) enterWake() bool {
+	if atomic.LoadInt32(&g.closed) == 1 {
+		return false
+	}
+	g.mu.RLock()
+	if atomic.LoadInt32(&g.closed) == 1 {
+		g.mu.RUnlock()
+		return false
+	}
+	return true
+}
+
+// exitWake ends the write started by enterWake.
+func (g *wakeGuard) exitWake() {
+	g.mu.RUnlock()
+}
+
+// shut marks the poller closed once the writes in progress end, it must be called before the wake fd is closed.
+func (g *wakeGuard) shut() {
+	g.mu.Lock()
+	atomic.StoreInt32(&g.closed, 1)
+	g.mu.Unlock()
+}
+
+// latencyIdlePeriod is the idle time counted as one iteration which takes no time in the average of latency,
+// an idle event-loop records no iterations at all, it might be blocked in waiting for network-events for good.
+const latencyIdlePeriod = 10 * time.Millisecond
+
+// latency tracks the exponentially weighted moving average of the duration of iterations, it is embedded by pollers.
+type latency struct {
+	ewma int64 // nanoseconds
+	last int64 // unix nanoseconds at the end of the latest iteration
+}
+
+// Latency returns the smoothed duration spent on handling the events of recent iterations,
+// it decays while the poller is idle.
+func (l *latency) Latency() time.Duration {
+	return time.Duration(decayLatency(atomic.LoadInt64(&l.ewma), time.Now().UnixNano()-atomic.LoadInt64(&l.last)))
+}
+
+// record folds the duration of the latest iteration started at the given time into the average with a weight of 1/8,
+// after the idle time since the previous one. It is only called by the goroutine running Polling.
+func (l *latency) record(start time.Time) {
+	now := time.Now().UnixNano()
+	old := decayLatency(atomic.LoadInt64(&l.ewma), start.UnixNano()-atomic.LoadInt64(&l.last))
+	atomic.StoreInt64(&l.ewma, old+(now-start.UnixNano()-old)/8)
+	atomic.StoreInt64(&l.last, now)
+}
+
+// decayLatency folds the idle time into the average as iterations which take no time, one per latencyIdlePeriod.
+func decayLatency(ewma, idle int64) int64 {
+	for n := idle / int64(latencyIdlePeriod); n > 0 && ewma > 0; n-- {
+		ewma -= ewma / 8
+		if ewma < 8 {
+			return 0
+		}
+	}
+	return ewma
+}
+
+// pollTimeout returns the timeout in milliseconds to wait for network-events,
+// msec is the value to use when no timer job is pending.
+func pollTimeout(timer Timer, msec int) int {
+	if msec == 0 || timer == nil {
+		return msec
+	}
+	d := timer.Timeout()
+	if d < 0 {
+		return msec
+	}
+	// Round up to avoid waking up a little bit earlier than the job is due.
+	return int((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// expireTimer runs the due timer jobs.
+func expireTimer(timer Timer) error {
+	if timer == nil || timer.Timeout() != 0 {
+		return nil
+	}
+	switch err := timer.Expire(); err {
+	case nil:
+	case errors.ErrServerShutdown:
+		return err
+	default:
+		logging.DefaultLogger.Warnf("Error occurs in timer: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// +build linux
+
+package netpoll
+
+import (
+	"testing"
+	"time"
+
+	"shpnetpoll/errors"
+)
+
+func TestLatencyDecaysWhileIdle(t *testing.T) {
+	var l latency
+	for i := 0; i < 64; i++ {
+		l.record(time.Now().Add(-time.Millisecond))
+	}
+	busy := l.Latency()
+	if busy < 900*time.Microsecond {
+		t.Fatalf("expect the latency of busy iterations to be about 1ms but got %v", busy)
+	}
+
+	// Pretend that the poller has been idle for a while.
+	l.last -= int64(5 * latencyIdlePeriod)
+	if idle := l.Latency(); idle >= busy*6/10 || idle <= busy*4/10 {
+		t.Fatalf("expect the latency to decay by 5 idle periods from %v but got %v", busy, idle)
+	}
+	l.last -= int64(time.Minute)
+	if idle := l.Latency(); idle != 0 {
+		t.Fatalf("expect the latency to decay to 0 after a long idle time but got %v", idle)
+	}
+
+	// A busy iteration after the idle time starts over from the decayed average.
+	l.record(time.Now().Add(-time.Millisecond))
+	if d := l.Latency(); d < 100*time.Microsecond || d > 200*time.Microsecond {
+		t.Fatalf("expect the latency to be 1/8 of the latest iteration but got %v", d)
+	}
+}
+
+func TestTriggerAfterClose(t *testing.T) {
+	open := map[string]func() (Poller, error){
+		"epoll":    func() (Poller, error) { return OpenPoller(0) },
+		"poll":     func() (Poller, error) { return OpenPollPoller(0) },
+		"io_uring": func() (Poller, error) { return OpenIOUringPoller(0, 0) },
+	}
+	for name, open := range open {
+		p, err := open()
+		if err != nil {
+			t.Logf("%s poller is not available: %v", name, err)
+			continue
+		}
+		if err = p.Close(); err != nil {
+			t.Fatal(err)
+		}
+		task := func() error { return nil }
+		if err = p.Trigger(task); err != errors.ErrPollerClosed {
+			t.Fatalf("expect Trigger of closed %s poller to fail with ErrPollerClosed but got %v", name, err)
+		}
+		if err = p.UrgentTrigger(task); err != errors.ErrPollerClosed {
+			t.Fatalf("expect UrgentTrigger of closed %s poller to fail with ErrPollerClosed but got %v", name, err)
+		}
+	}
+}
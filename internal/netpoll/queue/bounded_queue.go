@@ -0,0 +1,98 @@
+package queue
+
+import "sync/atomic"
+
+// boundedQueue is a bounded multi-producer single-consumer queue built on a ring of slots, based on the bounded
+// MPMC queue by Dmitry Vyukov: http://www.1024cores.net/home/lock-free-algorithms/queues/bounded-mpmc-queue
+//
+// Every slot carries a sequence number telling whose turn it is: a producer may fill the slot at position pos
+// once its sequence equals pos, and the consumer may take it once its sequence equals pos+1.
+type boundedQueue struct {
+	total uint64   // kept first for 64-bit alignment
+	tail  uint64   // position of the next slot to fill, shared by producers
+	_     [56]byte // keeps head and tail in separate cache lines
+	head  uint64   // position of the next slot to take, only written by the consumer
+	slots []slot
+}
+
+type slot struct {
+	seq  uint64
+	task Task
+}
+
+// NewBoundedQueue instantiates and returns a boundedQueue which holds up to capacity tasks,
+// only a single goroutine may dequeue from it.
+func NewBoundedQueue(capacity int) AsyncTaskQueue {
+	// A single slot can't tell a task put in it from the turn of the next lap.
+	if capacity < 2 {
+		capacity = 2
+	}
+	q := &boundedQueue{slots: make([]slot, capacity)}
+	for i := range q.slots {
+		q.slots[i].seq = uint64(i)
+	}
+	return q
+}
+
+// Enqueue puts the given task at the tail of the queue, it returns false if the queue is full.
+func (q *boundedQueue) Enqueue(task Task) bool {
+	size := uint64(len(q.slots))
+	for {
+		pos := atomic.LoadUint64(&q.tail)
+		s := &q.slots[pos%size]
+		switch seq := atomic.LoadUint64(&s.seq); {
+		case seq == pos:
+			// The slot is free, try to claim it.
+			if atomic.CompareAndSwapUint64(&q.tail, pos, pos+1) {
+				s.task = task
+				atomic.StoreUint64(&s.seq, pos+1)
+				atomic.AddUint64(&q.total, 1)
+				return true
+			}
+		case seq < pos:
+			// The slot still holds the task put a lap ago, the queue is full.
+			return false
+		}
+		// Another producer has claimed the slot, try again with the new tail.
+	}
+}
+
+// Dequeue removes and returns the task at the head of the queue.
+// It returns nil if the queue is empty or the task at the head is still being put by its producer.
+func (q *boundedQueue) Dequeue() Task {
+	pos := q.head
+	s := &q.slots[pos%uint64(len(q.slots))]
+	if atomic.LoadUint64(&s.seq) != pos+1 {
+		return nil
+	}
+	task := s.task
+	s.task = nil
+	// Hand the slot over to the producer of the next lap.
+	atomic.StoreUint64(&s.seq, pos+uint64(len(q.slots)))
+	atomic.StoreUint64(&q.head, pos+1)
+	return task
+}
+
+// Empty indicates whether this queue is empty or not.
+func (q *boundedQueue) Empty() bool {
+	return q.Len() == 0
+}
+
+// Len returns the number of tasks in this queue, including the ones being put.
+func (q *boundedQueue) Len() int {
+	head := atomic.LoadUint64(&q.head)
+	tail := atomic.LoadUint64(&q.tail)
+	switch {
+	case tail <= head:
+		return 0
+	case tail-head > uint64(len(q.slots)):
+		// The consumer has moved on since head was loaded.
+		return len(q.slots)
+	}
+	return int(tail - head)
+}
+
+// Total returns the number of tasks ever put in this queue.
+func (q *boundedQueue) Total() uint64 {
+	return atomic.LoadUint64(&q.total)
+}
@@ -0,0 +1,130 @@
+package queue
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestBoundedQueueFullAndEmpty(t *testing.T) {
+	q := NewBoundedQueue(3)
+	if !q.Empty() || q.Len() != 0 || q.Dequeue() != nil {
+		t.Fatalf("expect an empty queue but got len %d", q.Len())
+	}
+
+	var ran []int
+	for i := 0; i < 3; i++ {
+		i := i
+		if !q.Enqueue(func() error { ran = append(ran, i); return nil }) {
+			t.Fatalf("expect the task %d to be put", i)
+		}
+	}
+	if q.Enqueue(func() error { return nil }) {
+		t.Fatal("expect the task to be rejected by a full queue")
+	}
+	if q.Len() != 3 || q.Total() != 3 {
+		t.Fatalf("expect len 3 and total 3 but got %d and %d", q.Len(), q.Total())
+	}
+
+	// A slot is free again once its task is taken.
+	_ = q.Dequeue()()
+	if !q.Enqueue(func() error { ran = append(ran, 3); return nil }) {
+		t.Fatal("expect the task to be put after a dequeue")
+	}
+	for task := q.Dequeue(); task != nil; task = q.Dequeue() {
+		_ = task()
+	}
+	if !q.Empty() || q.Total() != 4 {
+		t.Fatalf("expect an empty queue with total 4 but got len %d and total %d", q.Len(), q.Total())
+	}
+	for i, v := range ran {
+		if v != i {
+			t.Fatalf("expect the tasks to run in order but got %v", ran)
+		}
+	}
+}
+
+func TestBoundedQueueMinimumCapacity(t *testing.T) {
+	q := NewBoundedQueue(1)
+	if !q.Enqueue(func() error { return nil }) || !q.Enqueue(func() error { return nil }) {
+		t.Fatal("expect a queue of capacity 1 to hold 2 tasks")
+	}
+	if q.Enqueue(func() error { return nil }) {
+		t.Fatal("expect the third task to be rejected")
+	}
+}
+
+func TestBoundedQueueWraparound(t *testing.T) {
+	q := NewBoundedQueue(4)
+	next := -1
+	// Go around the ring many laps with the queue partially filled, so that every slot is reused.
+	for lap := 0; lap < 1000; lap++ {
+		for i := 0; i < 3; i++ {
+			v := lap*3 + i
+			if !q.Enqueue(func() error { return checkNext(t, &next, v) }) {
+				t.Fatalf("expect the task %d to be put", v)
+			}
+		}
+		for i := 0; i < 3; i++ {
+			task := q.Dequeue()
+			if task == nil {
+				t.Fatalf("expect a task in lap %d", lap)
+			}
+			_ = task()
+		}
+		if !q.Empty() {
+			t.Fatalf("expect an empty queue after lap %d but got len %d", lap, q.Len())
+		}
+	}
+}
+
+func TestBoundedQueueConcurrentProducers(t *testing.T) {
+	const producers, tasks = 8, 10000
+	for _, capacity := range []int{2, 7, 1024} {
+		q := NewBoundedQueue(capacity)
+		last := make([]int, producers)
+		var wg sync.WaitGroup
+		for p := 0; p < producers; p++ {
+			p := p
+			last[p] = -1
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < tasks; {
+					v := i
+					if q.Enqueue(func() error { return checkNext(t, &last[p], v) }) {
+						i++
+					} else {
+						runtime.Gosched()
+					}
+				}
+			}()
+		}
+
+		// The single consumer runs the tasks of every producer in the order they were put.
+		for n := 0; n < producers*tasks; {
+			if task := q.Dequeue(); task != nil {
+				_ = task()
+				n++
+			} else {
+				runtime.Gosched()
+			}
+			if l := q.Len(); l > capacity {
+				t.Fatalf("expect len no more than %d but got %d", capacity, l)
+			}
+		}
+		wg.Wait()
+		if !q.Empty() || q.Total() != producers*tasks {
+			t.Fatalf("expect an empty queue with total %d but got len %d and total %d",
+				producers*tasks, q.Len(), q.Total())
+		}
+	}
+}
+
+func checkNext(t *testing.T, last *int, v int) error {
+	if v != *last+1 {
+		t.Errorf("expect %d after %d but got %d", *last+1, *last, v)
+	}
+	*last = v
+	return nil
+}
@@ -70,9 +70,10 @@ import (
 
 // lockFreeQueue is a simple, fast, and practical non-blocking and concurrent queue with no lock.
 type lockFreeQueue struct {
-	head unsafe.Pointer
-	tail unsafe.Pointer
-	len  int32
+	total uint64 // kept first for 64-bit alignment
+	head  unsafe.Pointer
+	tail  unsafe.Pointer
+	len   int32
 }
 
 type node struct {
@@ -86,8 +87,8 @@ func NewLockFreeQueue() AsyncTaskQueue {
 	return &lockFreeQueue{head: n, tail: n}
 }
 
-// Enqueue puts the given value v at the tail of the queue.
-func (q *lockFreeQueue) Enqueue(task Task) {
+// Enqueue puts the given value v at the tail of the queue, it never fails since the queue is unbounded.
+func (q *lockFreeQueue) Enqueue(task Task) bool {
 	n := &node{value: task}
 loop:
 	tail := load(&q.tail)
@@ -100,7 +101,8 @@ loop:
 				// Enqueue is done. Try to swing tail to the inserted node.
 				cas(&q.tail, tail, n)
 				atomic.AddInt32(&q.len, 1)
-				return
+				atomic.AddUint64(&q.total, 1)
+				return true
 			}
 		} else { // tail was not pointing to the last node
 			// Try to swing Tail to the next node.
@@ -144,6 +146,16 @@ func (q *lockFreeQueue) Empty() bool {
 	return atomic.LoadInt32(&q.len) == 0
 }
 
+// Len returns the number of tasks in this queue.
+func (q *lockFreeQueue) Len() int {
+	return int(atomic.LoadInt32(&q.len))
+}
+
+// Total returns the number of tasks ever put in this queue.
+func (q *lockFreeQueue) Total() uint64 {
+	return atomic.LoadUint64(&q.total)
+}
+
 func load(p *unsafe.Pointer) (n *node) {
 	return (*node)(atomic.LoadPointer(p))
 }
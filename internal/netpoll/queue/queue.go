@@ -5,7 +5,10 @@ type Task func() error
 
 // AsyncTaskQueue is a queue storing asynchronous tasks.
 type AsyncTaskQueue interface {
-	Enqueue(Task)
+	// Enqueue puts the task at the tail of the queue, it returns false if the queue is full.
+	Enqueue(Task) bool
 	Dequeue() Task
 	Empty() bool
+	Len() int
+	Total() uint64
 }
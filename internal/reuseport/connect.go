@@ -0,0 +1,49 @@
+// +build linux freebsd dragonfly darwin
+
+package reuseport
+
+import (
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+	"shpnetpoll/errors"
+)
+
+// Connect creates a non-blocking socket and initiates a connection to the given address on it,
+// it doesn't wait for the connection to be established: a connection in progress is reported as a nil error,
+// the caller ought to wait for the socket to become writable and check SO_ERROR afterwards.
+func Connect(proto, addr string) (fd int, netAddr net.Addr, err error) {
+	var (
+		family   int
+		sotype   = unix.SOCK_STREAM
+		sockaddr unix.Sockaddr
+	)
+
+	switch proto {
+	case "tcp", "tcp4", "tcp6":
+		sockaddr, family, netAddr, err = getTCPSockaddr(proto, addr)
+	case "unix":
+		sockaddr, family, netAddr, err = getUnixSockaddr(proto, addr)
+	default:
+		err = errors.ErrUnsupportedProtocol
+	}
+	if err != nil {
+		return
+	}
+
+	if fd, err = sysSocket(family, sotype, 0); err != nil {
+		err = os.NewSyscallError("socket", err)
+		return
+	}
+
+	switch err = unix.Connect(fd, sockaddr); err {
+	case nil, unix.EINPROGRESS, unix.EINTR:
+		err = nil
+	default:
+		_ = unix.Close(fd)
+		err = os.NewSyscallError("connect", err)
+	}
+
+	return
+}
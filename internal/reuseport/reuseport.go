@@ -10,3 +10,13 @@ import (
 func TCPSocket(proto, addr string, reusePort bool) (int, net.Addr, error) {
 	return tcpReusablePort(proto, addr, reusePort)
 }
+
+// UDPSocket calls udpReusablePort.
+func UDPSocket(proto, addr string, reusePort bool) (int, net.Addr, error) {
+	return udpReusablePort(proto, addr, reusePort)
+}
+
+// UnixSocket calls udsReusablePort.
+func UnixSocket(proto, addr string, reusePort bool) (int, net.Addr, error) {
+	return udsReusablePort(proto, addr, reusePort)
+}
@@ -0,0 +1,128 @@
+// +build linux freebsd dragonfly darwin
+
+package reuseport
+
+import (
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+	"shpnetpoll/errors"
+)
+
+func getUDPSockaddr(proto, addr string) (sa unix.Sockaddr, family int, udpAddr *net.UDPAddr, err error) {
+	var udpVersion string
+
+	udpAddr, err = net.ResolveUDPAddr(proto, addr)
+	if err != nil {
+		return
+	}
+
+	udpVersion, err = determineUDPProto(proto, udpAddr)
+	if err != nil {
+		return
+	}
+
+	switch udpVersion {
+	case "udp":
+		sa, family = &unix.SockaddrInet4{Port: udpAddr.Port}, unix.AF_INET
+	case "udp4":
+		sa4 := &unix.SockaddrInet4{Port: udpAddr.Port}
+
+		if udpAddr.IP != nil {
+			if len(udpAddr.IP) == 16 {
+				copy(sa4.Addr[:], udpAddr.IP[12:16]) // copy last 4 bytes of slice to array
+			} else {
+				copy(sa4.Addr[:], udpAddr.IP) // copy all bytes of slice to array
+			}
+		}
+
+		sa, family = sa4, unix.AF_INET
+	case "udp6":
+		sa6 := &unix.SockaddrInet6{Port: udpAddr.Port}
+
+		if udpAddr.IP != nil {
+			copy(sa6.Addr[:], udpAddr.IP) // copy all bytes of slice to array
+		}
+
+		if udpAddr.Zone != "" {
+			var iface *net.Interface
+			iface, err = net.InterfaceByName(udpAddr.Zone)
+			if err != nil {
+				return
+			}
+
+			sa6.ZoneId = uint32(iface.Index)
+		}
+
+		sa, family = sa6, unix.AF_INET6
+	default:
+		err = errors.ErrUnsupportedProtocol
+	}
+
+	return
+}
+
+func determineUDPProto(proto string, addr *net.UDPAddr) (string, error) {
+	// If the protocol is set to "udp", we try to determine the actual protocol
+	// version from the size of the resolved IP address. Otherwise, we simple use
+	// the protocol given to us by the caller.
+
+	if addr.IP.To4() != nil {
+		return "udp4", nil
+	}
+
+	if addr.IP.To16() != nil {
+		return "udp6", nil
+	}
+
+	switch proto {
+	case "udp", "udp4", "udp6":
+		return proto, nil
+	}
+
+	return "", errors.ErrUnsupportedUDPProtocol
+}
+
+// udpReusablePort creates an endpoint for communication and returns a file descriptor that refers to that endpoint.
+// Argument `reusePort` indicates whether the SO_REUSEPORT flag will be assigned, with which the kernel distributes
+// incoming datagrams across all sockets bound to the same address, one per event-loop.
+func udpReusablePort(proto, addr string, reusePort bool) (fd int, netAddr net.Addr, err error) {
+	var (
+		family   int
+		sockaddr unix.Sockaddr
+	)
+
+	if sockaddr, family, netAddr, err = getUDPSockaddr(proto, addr); err != nil {
+		return
+	}
+
+	if fd, err = sysSocket(family, unix.SOCK_DGRAM, unix.IPPROTO_UDP); err != nil {
+		err = os.NewSyscallError("socket", err)
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = unix.Close(fd)
+		}
+	}()
+
+	if err = os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)); err != nil {
+		return
+	}
+
+	// Allow broadcast.
+	if err = os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_BROADCAST, 1)); err != nil {
+		return
+	}
+
+	if reusePort {
+		if err = os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)); err != nil {
+			return
+		}
+	}
+
+	err = os.NewSyscallError("bind", unix.Bind(fd, sockaddr))
+
+	return
+}
@@ -0,0 +1,71 @@
+// +build linux freebsd dragonfly darwin
+
+package reuseport
+
+import (
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+	"shpnetpoll/errors"
+)
+
+func getUnixSockaddr(proto, addr string) (sa unix.Sockaddr, family int, unixAddr *net.UnixAddr, err error) {
+	unixAddr, err = net.ResolveUnixAddr(proto, addr)
+	if err != nil {
+		return
+	}
+
+	switch unixAddr.Net {
+	case "unix":
+		// An address starting with '@' lives in the Linux abstract namespace,
+		// unix.SockaddrUnix takes care of translating it into a leading NUL byte.
+		sa, family = &unix.SockaddrUnix{Name: unixAddr.Name}, unix.AF_UNIX
+	default:
+		err = errors.ErrUnsupportedUDSProtocol
+	}
+
+	return
+}
+
+// udsReusablePort creates an endpoint for communication and returns a file descriptor that refers to that endpoint.
+// Argument `reusePort` indicates whether the SO_REUSEPORT flag will be assigned.
+func udsReusablePort(proto, addr string, reusePort bool) (fd int, netAddr net.Addr, err error) {
+	var (
+		family   int
+		sockaddr unix.Sockaddr
+	)
+
+	if sockaddr, family, netAddr, err = getUnixSockaddr(proto, addr); err != nil {
+		return
+	}
+
+	if fd, err = sysSocket(family, unix.SOCK_STREAM, 0); err != nil {
+		err = os.NewSyscallError("socket", err)
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = unix.Close(fd)
+		}
+	}()
+
+	if err = os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)); err != nil {
+		return
+	}
+
+	if reusePort {
+		if err = os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)); err != nil {
+			return
+		}
+	}
+
+	if err = os.NewSyscallError("bind", unix.Bind(fd, sockaddr)); err != nil {
+		return
+	}
+
+	// Set backlog size to the maximum.
+	err = os.NewSyscallError("listen", unix.Listen(fd, listenerBacklogMaxSize))
+
+	return
+}
@@ -0,0 +1,163 @@
+// Package timingwheel delivers a hashed timing wheel which schedules a massive number of timers with O(1)
+// insertion and removal, it is owned by a single event-loop and therefore not safe for concurrent use.
+package timingwheel
+
+import "time"
+
+// Task is the job run when a timer expires.
+type Task func() error
+
+// Timer represents a single event scheduled in TimingWheel.
+type Timer struct {
+	tw         *TimingWheel
+	slot       int
+	rounds     int
+	task       Task
+	prev, next *Timer
+}
+
+// Stop prevents the Timer from firing, it returns false if the timer has already fired or been stopped.
+func (t *Timer) Stop() bool {
+	if t == nil || t.tw == nil {
+		return false
+	}
+	if t.slot == expiredSlot {
+		// The timer has expired but its task is still waiting to be run.
+		t.tw, t.task = nil, nil
+		return true
+	}
+	t.tw.remove(t)
+	t.tw = nil
+	return true
+}
+
+// expiredSlot marks a timer which has been taken out of wheel for running its task.
+const expiredSlot = -1
+
+// TimingWheel is a hashed timing wheel, each slot holds a doubly linked list of timers whose
+// expirations fall into it, timers farther than one revolution count down the remaining rounds.
+type TimingWheel struct {
+	tick    time.Duration
+	slots   []*Timer  // heads of the timer list in every slot
+	cursor  int       // slot of the current tick
+	current time.Time // start time of the current tick
+	count   int       // number of timers in slots
+	expired []*Timer  // expired timers whose tasks have not been run yet
+}
+
+// New instantiates a timing wheel with the given tick and number of slots.
+func New(tick time.Duration, size int) *TimingWheel {
+	if tick <= 0 {
+		tick = time.Millisecond
+	}
+	if size <= 0 {
+		size = 1
+	}
+	return &TimingWheel{
+		tick:    tick,
+		slots:   make([]*Timer, size),
+		current: time.Now().Truncate(tick),
+	}
+}
+
+// Len returns the number of pending timers.
+func (tw *TimingWheel) Len() int {
+	return tw.count + len(tw.expired)
+}
+
+// AfterFunc schedules the task to run after duration d, the precision is bounded by the tick of wheel.
+func (tw *TimingWheel) AfterFunc(d time.Duration, task Task) *Timer {
+	if tw.count == 0 {
+		// Nothing is scheduled, fast-forward to the present instead of stepping through every idle tick.
+		tw.current = time.Now().Truncate(tw.tick)
+	}
+
+	ticks := int((time.Until(tw.current) + d + tw.tick - 1) / tw.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	t := &Timer{
+		tw:     tw,
+		slot:   (tw.cursor + ticks) % len(tw.slots),
+		rounds: (ticks - 1) / len(tw.slots),
+		task:   task,
+	}
+	t.next = tw.slots[t.slot]
+	if t.next != nil {
+		t.next.prev = t
+	}
+	tw.slots[t.slot] = t
+	tw.count++
+	return t
+}
+
+func (tw *TimingWheel) remove(t *Timer) {
+	if t.prev != nil {
+		t.prev.next = t.next
+	} else {
+		tw.slots[t.slot] = t.next
+	}
+	if t.next != nil {
+		t.next.prev = t.prev
+	}
+	t.prev, t.next = nil, nil
+	tw.count--
+}
+
+// Timeout returns the duration until the next tick of wheel is due,
+// or a negative duration if no timer is pending.
+func (tw *TimingWheel) Timeout() time.Duration {
+	if len(tw.expired) > 0 {
+		return 0
+	}
+	if tw.count == 0 {
+		return -1
+	}
+	if d := time.Until(tw.current.Add(tw.tick)); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Expire advances the wheel to the present and runs the tasks of all expired timers.
+// It stops at the first error returned by a task, the expired timers left behind will be run on the next call.
+func (tw *TimingWheel) Expire() error {
+	now := time.Now()
+	for {
+		for len(tw.expired) > 0 {
+			t := tw.expired[0]
+			tw.expired[0] = nil
+			tw.expired = tw.expired[1:]
+			if t.task == nil {
+				continue
+			}
+			t.tw = nil
+			if err := t.task(); err != nil {
+				return err
+			}
+		}
+
+		if tw.count == 0 {
+			tw.current = now.Truncate(tw.tick)
+			return nil
+		}
+		if tw.current.Add(tw.tick).After(now) {
+			return nil
+		}
+
+		next := (tw.cursor + 1) % len(tw.slots)
+		for t := tw.slots[next]; t != nil; {
+			cur := t
+			t = t.next
+			if cur.rounds > 0 {
+				cur.rounds--
+				continue
+			}
+			tw.remove(cur)
+			cur.slot = expiredSlot
+			tw.expired = append(tw.expired, cur)
+		}
+		tw.cursor = next
+		tw.current = tw.current.Add(tw.tick)
+	}
+}
@@ -0,0 +1,87 @@
+package timingwheel
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTimingWheel_Expire(t *testing.T) {
+	tw := New(time.Millisecond, 8)
+	if d := tw.Timeout(); d >= 0 {
+		t.Fatalf("expect negative timeout on empty wheel but got %v", d)
+	}
+
+	var fired []int
+	for i, d := range []time.Duration{2 * time.Millisecond, 5 * time.Millisecond, 20 * time.Millisecond} {
+		i := i
+		tw.AfterFunc(d, func() error {
+			fired = append(fired, i)
+			return nil
+		})
+	}
+	stopped := tw.AfterFunc(3*time.Millisecond, func() error {
+		t.Fatal("stopped timer should not fire")
+		return nil
+	})
+	if !stopped.Stop() {
+		t.Fatal("expect Stop to report true for a pending timer")
+	}
+	if stopped.Stop() {
+		t.Fatal("expect Stop to report false for a stopped timer")
+	}
+	if tw.Len() != 3 {
+		t.Fatalf("expect 3 pending timers but got %d", tw.Len())
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if err := tw.Expire(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fired) != 2 || fired[0] != 0 || fired[1] != 1 {
+		t.Fatalf("expect timers 0 and 1 to fire but got %v", fired)
+	}
+
+	// The last timer is farther than one revolution of wheel.
+	time.Sleep(15 * time.Millisecond)
+	if err := tw.Expire(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fired) != 3 || fired[2] != 2 {
+		t.Fatalf("expect timer 2 to fire but got %v", fired)
+	}
+	if tw.Len() != 0 {
+		t.Fatalf("expect empty wheel but got %d pending timers", tw.Len())
+	}
+}
+
+func TestTimingWheel_ExpireError(t *testing.T) {
+	tw := New(time.Millisecond, 8)
+	errStop := errors.New("stop")
+	var calls int
+	tw.AfterFunc(time.Millisecond, func() error {
+		calls++
+		return errStop
+	})
+	tw.AfterFunc(time.Millisecond, func() error {
+		calls++
+		return errStop
+	})
+
+	time.Sleep(3 * time.Millisecond)
+	if err := tw.Expire(); err != errStop || calls != 1 {
+		t.Fatalf("expect error %v after 1 task but got %v after %d tasks", errStop, err, calls)
+	}
+	if tw.Timeout() != 0 {
+		t.Fatal("expect the remaining expired timer to be due immediately")
+	}
+	if err := tw.Expire(); err != errStop {
+		t.Fatalf("expect error %v but got %v", errStop, err)
+	}
+	if err := tw.Expire(); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("expect 2 tasks to run but got %d", calls)
+	}
+}
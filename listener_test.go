@@ -0,0 +1,46 @@
+// +build linux freebsd dragonfly darwin
+
+package shpnetpoll
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixSocketMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.sock")
+
+	ln, err := initListener("unix", path, &Options{UnixSocketMode: 0640})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0640 {
+		t.Fatalf("expect a socket file of mode 0640 but got %v", fi.Mode())
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, ".sock-*")); len(names) > 0 {
+		t.Fatalf("expect the private directory of binding to be removed but got %v", names)
+	}
+	cli, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("expect the socket file to be connected to: %v", err)
+	}
+	_ = cli.Close()
+
+	// The socket file of a live listener is never replaced.
+	if _, err = initListener("unix", path, &Options{UnixSocketMode: 0600}); err == nil {
+		t.Fatal("expect binding to the address of a live listener to fail")
+	}
+}
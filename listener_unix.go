@@ -3,13 +3,17 @@
 package shpnetpoll
 
 import (
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"shpnetpoll/internal/reuseport"
+	"strings"
 	"sync"
 
 	"github.com/panjf2000/gnet/errors"
 	"golang.org/x/sys/unix"
+	gerrors "shpnetpoll/errors"
 	"shpnetpoll/internal/netpoll"
 )
 
@@ -19,37 +23,192 @@ type listener struct {
 	lnaddr        net.Addr
 	reusePort     bool
 	addr, network string
+	sockMode      os.FileMode      // file mode of the Unix Domain Socket file
+	sockOwner     *UnixSocketOwner // ownership of the Unix Domain Socket file
+	detached      bool             // the socket has been handed over to another process, keep its file on close
+	activated     bool             // the socket is passed in by a supervisor, it can't be bound once more
+	activatedAs   string           // the address of fd or listen-fds network the socket is passed in with
 }
 
 func (ln *listener) Dup() (int, string, error) {
 	return netpoll.Dup(ln.fd)
 }
 
+// isAbstract reports whether the listener is bound to an address in the Linux abstract socket namespace,
+// which has no counterpart in the file system.
+func (ln *listener) isAbstract() bool {
+	return ln.network == "unix" && strings.HasPrefix(ln.addr, "@")
+}
+
 func (ln *listener) normalize() (err error) {
 	switch ln.network {
 	case "tcp", "tcp4", "tcp6":
 		ln.fd, ln.lnaddr, err = reuseport.TCPSocket(ln.network, ln.addr, ln.reusePort)
 		ln.network = "tcp"
+	case "udp", "udp4", "udp6":
+		ln.fd, ln.lnaddr, err = reuseport.UDPSocket(ln.network, ln.addr, ln.reusePort)
+		ln.network = "udp"
+	case "unix":
+		if !ln.isAbstract() {
+			removeStaleSocket(ln.addr)
+		}
+		if ln.isAbstract() || (ln.sockMode == 0 && ln.sockOwner == nil) {
+			ln.fd, ln.lnaddr, err = reuseport.UnixSocket(ln.network, ln.addr, ln.reusePort)
+			return
+		}
+		err = ln.bindPrivately()
 	default:
 		err = errors.ErrUnsupportedProtocol
 	}
 	return
 }
 
+// bindPrivately binds the Unix Domain Socket listener in a private directory next to its socket file, applies
+// the configured ownership and mode to the socket file there and then links it into place, so that nobody is able
+// to connect before that. Unlike changing the umask, it doesn't affect the files created by the rest of process.
+func (ln *listener) bindPrivately() error {
+	dir, err := ioutil.TempDir(filepath.Dir(ln.addr), ".sock-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "s")
+	fd, _, err := reuseport.UnixSocket(ln.network, path, ln.reusePort)
+	if err != nil {
+		return err
+	}
+	if err = ln.chmod(path); err == nil {
+		// Unlike rename, link never replaces the socket file of a live listener bound in the meantime.
+		if err = os.Link(path, ln.addr); os.IsExist(err) {
+			err = os.NewSyscallError("bind", unix.EADDRINUSE)
+		}
+	}
+	if err != nil {
+		_ = unix.Close(fd)
+		return err
+	}
+	ln.fd, ln.lnaddr = fd, &net.UnixAddr{Name: ln.addr, Net: ln.network}
+	return nil
+}
+
+// chmod applies the configured ownership and file mode to the socket file at the given path, the file keeps the mode
+// derived from the umask if no mode is configured. The ownership goes first, so that the file is only opened up to
+// the group once it belongs to the right one.
+func (ln *listener) chmod(path string) error {
+	if ln.sockOwner != nil {
+		if err := os.Chown(path, ln.sockOwner.UID, ln.sockOwner.GID); err != nil {
+			return err
+		}
+	}
+	if ln.sockMode == 0 {
+		return nil
+	}
+	return os.Chmod(path, ln.sockMode)
+}
+
+// removeStaleSocket removes the socket file left behind by a previous process, it never touches a path that is not
+// a socket, nor a socket which some process is still listening on: the file is only removed if connecting to it is
+// refused.
+func removeStaleSocket(path string) {
+	if fi, err := os.Lstat(path); err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return
+	}
+	defer unix.Close(fd)
+	// Don't get stuck on a live listener whose accept queue is full.
+	if err = unix.SetNonblock(fd, true); err != nil {
+		return
+	}
+	if err = unix.Connect(fd, &unix.SockaddrUnix{Name: path}); err == unix.ECONNREFUSED {
+		_ = os.Remove(path)
+	}
+}
+
 func (ln *listener) close() {
 	ln.once.Do(
 		func() {
 			if ln.fd > 0 {
 				sniffErrorAndLog(os.NewSyscallError("close", unix.Close(ln.fd)))
 			}
-			if ln.network == "unix" {
+			if ln.network == "unix" && !ln.isAbstract() && !ln.detached && !ln.activated {
 				sniffErrorAndLog(os.RemoveAll(ln.addr))
 			}
 		})
 }
 
-func initListener(network, addr string, reusePort bool) (l *listener, err error) {
-	l = &listener{network: network, addr: addr, reusePort: reusePort}
+func initListener(network, addr string, options *Options) (l *listener, err error) {
+	if network == "fd" || network == "listen-fds" {
+		return activatedListener(network, addr, options)
+	}
+	if fd, ok := takeInheritedFd(network, addr); ok {
+		if l, err = fileListener(network, addr, fd, options); err != nil {
+			_ = unix.Close(fd)
+		}
+		return
+	}
+	l = &listener{
+		network:   network,
+		addr:      addr,
+		reusePort: options.ReusePort,
+		sockMode:  options.UnixSocketMode,
+		sockOwner: options.UnixSocketOwner,
+	}
 	err = l.normalize()
 	return
 }
+
+// canonicalNetwork returns the network that listeners of the given network scheme are marked with.
+func canonicalNetwork(network string) string {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return "tcp"
+	case "udp", "udp4", "udp6":
+		return "udp"
+	case "unix":
+		return "unix"
+	}
+	return ""
+}
+
+// fileListener wraps the listening socket fd inherited from another process into a listener,
+// it makes sure that the socket is of the given network.
+func fileListener(network, addr string, fd int, options *Options) (*listener, error) {
+	l := &listener{network: canonicalNetwork(network), addr: addr, fd: fd, reusePort: options.ReusePort}
+	if l.network == "" {
+		return nil, errors.ErrUnsupportedProtocol
+	}
+
+	soType, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TYPE)
+	if err != nil {
+		return nil, os.NewSyscallError("getsockopt", err)
+	}
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return nil, os.NewSyscallError("getsockname", err)
+	}
+	if _, isUnix := sa.(*unix.SockaddrUnix); isUnix != (l.network == "unix") {
+		return nil, gerrors.ErrInvalidListenerFd
+	}
+	if l.network == "udp" {
+		if soType != unix.SOCK_DGRAM {
+			return nil, gerrors.ErrInvalidListenerFd
+		}
+		l.lnaddr = netpoll.SockaddrToUDPAddr(sa)
+	} else {
+		if soType != unix.SOCK_STREAM {
+			return nil, gerrors.ErrInvalidListenerFd
+		}
+		if accepting, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ACCEPTCONN); err != nil || accepting == 0 {
+			return nil, gerrors.ErrInvalidListenerFd
+		}
+		l.lnaddr = netpoll.SockaddrToTCPOrUnixAddr(sa)
+	}
+
+	if err = unix.SetNonblock(fd, true); err != nil {
+		return nil, os.NewSyscallError("fcntl nonblock", err)
+	}
+	return l, nil
+}
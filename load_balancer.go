@@ -3,11 +3,16 @@ package shpnetpoll
 import (
 	"container/heap"
 	"hash/crc32"
+	"hash/fnv"
 	"net"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"shpnetpoll/internal"
+	"shpnetpoll/internal/logging"
 )
 
 // LoadBalancing represents the the type of load-balancing algorithm.
@@ -23,23 +28,109 @@ const (
 
 	// SourceAddrHash assignes the next accepted connection to the event-loop by hashing the remote address.
 	SourceAddrHash
+
+	// ConsistentHash assigns the next accepted connection to the event-loop by looking up the remote IP on
+	// a consistent-hash ring, connections from the same host stick to the same event-loop regardless of
+	// their ports, and only a few hosts are remapped when the number of event-loops changes.
+	ConsistentHash
+
+	// WeightedRoundRobin assigns the next accepted connection to the event-loop in proportion to its weight
+	// set by WithLoadBalancingWeights, in a smooth way that interleaves event-loops as evenly as possible.
+	// Event-loops weighted 0 receive no new connections unless all of them are weighted 0.
+	WeightedRoundRobin
+
+	// PowerOfTwoChoices assigns the next accepted connection to the less loaded one of two event-loops sampled
+	// at random, the load takes into account the number of connections, the bytes pending in outbound buffers,
+	// the depth of asynchronous task queue and the time spent on recent iterations, so the event-loops
+	// burdened with a few heavy connections are avoided as well as the crowded ones.
+	PowerOfTwoChoices
 )
 
+// The pressure of event-loop equivalent to one connection in the load of PowerOfTwoChoices.
+const (
+	p2cOutboundUnit = 64 << 10              // bytes pending in outbound buffers
+	p2cTaskUnit     = 1                     // asynchronous tasks waiting in queue
+	p2cLatencyUnit  = 50 * time.Microsecond // time spent on one iteration
+)
+
+// virtualNodes is the number of points each event-loop owns on the consistent-hash ring.
+const virtualNodes = 160
+
+// EventLoopInfo is a read-only view of an event-loop for LoadBalancer, its methods are safe to be called
+// from any goroutine.
+type EventLoopInfo interface {
+	// Index returns the index of event-loop, which is assigned in the order of registration starting from 0.
+	Index() int
+
+	// ConnCount returns the number of active connections in event-loop.
+	ConnCount() int32
+
+	// OutboundBytes returns the number of bytes pending in the outbound buffers of connections in event-loop.
+	OutboundBytes() int64
+
+	// PendingTasks returns the number of asynchronous tasks waiting to be run by event-loop.
+	PendingTasks() int
+
+	// Latency returns the smoothed duration that event-loop spent on handling the events of its recent iterations,
+	// which decays while event-loop is idle.
+	Latency() time.Duration
+}
+
+// LoadBalancer manipulates the event-loop set and picks one of them for every new connection, it can be plugged
+// into server and client via WithCustomLoadBalancer in place of the built-in algorithms.
+//
+// Register is called before the event-loop starts, Next is called by the main reactor for accepted connections
+// and by the goroutines calling Client.Dial, while Calibrate is called concurrently by all event-loops,
+// so implementations must take care of synchronization.
+type LoadBalancer interface {
+	// Register adds an event-loop to the set, the index of event-loop is always the number of event-loops
+	// registered before it.
+	Register(el EventLoopInfo)
+
+	// Unregister removes an event-loop from the set when it's retired by Server.ScaleEventLoops, it is always
+	// the one with the highest index, Next must not return it any longer once Unregister returns.
+	Unregister(el EventLoopInfo)
+
+	// Next returns the event-loop that the new connection from the given address will be assigned to,
+	// it must be one of the registered event-loops.
+	Next(addr net.Addr) EventLoopInfo
+
+	// Iterate calls f on every registered event-loop until f returns false.
+	Iterate(f func(i int, el EventLoopInfo) bool)
+
+	// Len returns the number of registered event-loops.
+	Len() int
+
+	// Calibrate is called after a connection has been opened (delta = 1) or closed (delta = -1) in event-loop,
+	// ConnCount of event-loop already takes it into account.
+	Calibrate(el EventLoopInfo, delta int32)
+}
+
 type (
 	// loadBalancer is a interface which manipulates the event-loop set.
 	loadBalancer interface {
 		register(*eventloop)
-		next(net.Addr) *eventloop
+		unregister(*eventloop)
+		next(net.Addr) *eventloop // nil if there is no event-loop to take the connection
 		iterate(func(int, *eventloop) bool)
 		len() int
 		calibrate(*eventloop, int32)
 	}
 
+	// baseLoadBalancer keeps the event-loop set for the load-balancers built on top of a list of event-loops.
+	//
+	// The list is copied on write, so that it can be iterated without holding the lock while event-loops are
+	// registered or unregistered by Server.ScaleEventLoops.
+	baseLoadBalancer struct {
+		sync.RWMutex
+		eventLoops []*eventloop
+		size       int
+	}
+
 	// roundRobinLoadBalancer with Round-Robin algorithm.
 	roundRobinLoadBalancer struct {
-		nextLoopIndex int
-		eventLoops    []*eventloop
-		size          int
+		baseLoadBalancer
+		nextLoopIndex uint64
 	}
 
 	// leastConnectionsLoadBalancer with Least-Connections algorithm.
@@ -53,44 +144,110 @@ type (
 
 	// sourceAddrHashLoadBalancer with Hash algorithm.
 	sourceAddrHashLoadBalancer struct {
-		eventLoops []*eventloop
-		size       int
+		baseLoadBalancer
+	}
+
+	// consistentHashLoadBalancer with Consistent-Hash algorithm.
+	consistentHashLoadBalancer struct {
+		baseLoadBalancer
+		ring []ringNode // points of all event-loops sorted by hash
+	}
+
+	// ringNode is a point on the consistent-hash ring.
+	ringNode struct {
+		hash uint32
+		el   *eventloop
+	}
+
+	// weightedRoundRobinLoadBalancer with Smooth-Weighted-Round-Robin algorithm.
+	weightedRoundRobinLoadBalancer struct {
+		baseLoadBalancer
+		weights []int // weights of event-loops by index
+		current []int // current weights of event-loops in the order of list
+	}
+
+	// powerOfTwoChoicesLoadBalancer with Power-of-Two-Choices algorithm.
+	powerOfTwoChoicesLoadBalancer struct {
+		baseLoadBalancer
+		seed uint64 // state of the random number generator
+	}
+
+	// customLoadBalancer adapts the LoadBalancer provided by users, it keeps track of the event-loops registered
+	// to it so that a broken one can't assign connections to unknown or retired event-loops.
+	customLoadBalancer struct {
+		sync.RWMutex
+		lb         LoadBalancer
+		registered map[*eventloop]bool
 	}
 )
 
-// ==================================== Implementation of Round-Robin load-balancer ====================================
+// ========================================= Implementation of base load-balancer ======================================
 
-func (lb *roundRobinLoadBalancer) register(el *eventloop) {
+// add appends the event-loop to the list and assigns its index, the caller must hold the lock.
+func (lb *baseLoadBalancer) add(el *eventloop) {
 	el.idx = lb.size
-	lb.eventLoops = append(lb.eventLoops, el)
+	lb.eventLoops = append(lb.eventLoops[:lb.size:lb.size], el)
 	lb.size++
 }
 
-// next returns the eligible event-loop based on Round-Robin algorithm.
-func (lb *roundRobinLoadBalancer) next(_ net.Addr) (el *eventloop) {
-	el = lb.eventLoops[lb.nextLoopIndex]
-	if lb.nextLoopIndex++; lb.nextLoopIndex >= lb.size {
-		lb.nextLoopIndex = 0
+// remove removes the event-loop from the list and returns its position, or -1 if it's not in the list,
+// the caller must hold the lock.
+func (lb *baseLoadBalancer) remove(el *eventloop) int {
+	for i, v := range lb.eventLoops {
+		if v == el {
+			eventLoops := make([]*eventloop, 0, lb.size-1)
+			lb.eventLoops = append(append(eventLoops, lb.eventLoops[:i]...), lb.eventLoops[i+1:]...)
+			lb.size--
+			return i
+		}
 	}
-	return
+	return -1
 }
 
-func (lb *roundRobinLoadBalancer) iterate(f func(int, *eventloop) bool) {
-	for i, el := range lb.eventLoops {
+func (lb *baseLoadBalancer) register(el *eventloop) {
+	lb.Lock()
+	lb.add(el)
+	lb.Unlock()
+}
+
+func (lb *baseLoadBalancer) unregister(el *eventloop) {
+	lb.Lock()
+	lb.remove(el)
+	lb.Unlock()
+}
+
+func (lb *baseLoadBalancer) iterate(f func(int, *eventloop) bool) {
+	lb.RLock()
+	eventLoops := lb.eventLoops
+	lb.RUnlock()
+	for i, el := range eventLoops {
 		if !f(i, el) {
 			break
 		}
 	}
 }
 
-func (lb *roundRobinLoadBalancer) len() int {
-	return lb.size
+func (lb *baseLoadBalancer) len() (size int) {
+	lb.RLock()
+	size = lb.size
+	lb.RUnlock()
+	return
 }
 
-func (lb *roundRobinLoadBalancer) calibrate(el *eventloop, delta int32) {
+func (lb *baseLoadBalancer) calibrate(el *eventloop, delta int32) {
 	atomic.AddInt32(&el.connCount, delta)
 }
 
+// ==================================== Implementation of Round-Robin load-balancer ====================================
+
+// next returns the eligible event-loop based on Round-Robin algorithm.
+func (lb *roundRobinLoadBalancer) next(_ net.Addr) (el *eventloop) {
+	lb.RLock()
+	el = lb.eventLoops[(atomic.AddUint64(&lb.nextLoopIndex, 1)-1)%uint64(lb.size)]
+	lb.RUnlock()
+	return
+}
+
 // ================================= Implementation of Least-Connections load-balancer =================================
 
 // Leverage min-heap to optimize Least-Connections load-balancing.
@@ -106,9 +263,10 @@ func (h minEventLoopHeap) Less(i, j int) bool {
 	return h[i].connCount < h[j].connCount
 }
 
+// Swap keeps idx of event-loops untouched since it is the index exposed via EventLoopInfo,
+// the positions in heap are never needed as the heap is only re-initialized as a whole.
 func (h minEventLoopHeap) Swap(i, j int) {
 	h[i], h[j] = h[j], h[i]
-	h[i].idx, h[j].idx = i, j
 }
 
 func (h *minEventLoopHeap) Push(x interface{}) {
@@ -122,7 +280,6 @@ func (h *minEventLoopHeap) Pop() interface{} {
 	i := len(old) - 1
 	x := old[i]
 	old[i] = nil // avoid memory leak
-	x.idx = -1   // for safety
 	*h = old[:i]
 	return x
 }
@@ -133,7 +290,23 @@ func (lb *leastConnectionsLoadBalancer) register(el *eventloop) {
 	if el.idx == 0 {
 		lb.cachedRoot = el
 	}
-	lb.calibrateConnsThreshold = int32(lb.minHeap.Len())
+	atomic.StoreInt32(&lb.calibrateConnsThreshold, int32(lb.minHeap.Len()))
+	lb.Unlock()
+}
+
+func (lb *leastConnectionsLoadBalancer) unregister(el *eventloop) {
+	lb.Lock()
+	for i, v := range lb.minHeap {
+		if v == el {
+			heap.Remove(&lb.minHeap, i)
+			break
+		}
+	}
+	if lb.cachedRoot == el {
+		heap.Init(&lb.minHeap)
+		lb.cachedRoot = lb.minHeap[0]
+	}
+	atomic.StoreInt32(&lb.calibrateConnsThreshold, int32(lb.minHeap.Len()))
 	lb.Unlock()
 }
 
@@ -146,14 +319,17 @@ func (lb *leastConnectionsLoadBalancer) next(_ net.Addr) (el *eventloop) {
 
 	// In most cases, `next` method returns the cached event-loop immediately and it only reconstructs the minimum heap
 	// every `calibrateConnsThreshold` times for reducing locks to global mutex.
-	if atomic.LoadInt32(&lb.threshold) >= lb.calibrateConnsThreshold {
+	if atomic.LoadInt32(&lb.threshold) >= atomic.LoadInt32(&lb.calibrateConnsThreshold) {
 		lb.Lock()
 		heap.Init(&lb.minHeap)
 		lb.cachedRoot = lb.minHeap[0]
 		atomic.StoreInt32(&lb.threshold, 0)
 		lb.Unlock()
 	}
-	return lb.cachedRoot
+	lb.RLock()
+	el = lb.cachedRoot
+	lb.RUnlock()
+	return
 }
 
 func (lb *leastConnectionsLoadBalancer) iterate(f func(int, *eventloop) bool) {
@@ -186,12 +362,6 @@ func (lb *leastConnectionsLoadBalancer) calibrate(el *eventloop, delta int32) {
 
 // ======================================= Implementation of Hash load-balancer ========================================
 
-func (lb *sourceAddrHashLoadBalancer) register(el *eventloop) {
-	el.idx = lb.size
-	lb.eventLoops = append(lb.eventLoops, el)
-	lb.size++
-}
-
 // hash hashes a string to a unique hash code.
 func (lb *sourceAddrHashLoadBalancer) hash(s string) int {
 	v := int(crc32.ChecksumIEEE(internal.StringToBytes(s)))
@@ -202,23 +372,245 @@ func (lb *sourceAddrHashLoadBalancer) hash(s string) int {
 }
 
 // next returns the eligible event-loop by taking the remainder of a hash code as the index of event-loop list.
-func (lb *sourceAddrHashLoadBalancer) next(netAddr net.Addr) *eventloop {
+func (lb *sourceAddrHashLoadBalancer) next(netAddr net.Addr) (el *eventloop) {
 	hashCode := lb.hash(netAddr.String())
-	return lb.eventLoops[hashCode%lb.size]
+	lb.RLock()
+	el = lb.eventLoops[hashCode%lb.size]
+	lb.RUnlock()
+	return
+}
+
+// =================================== Implementation of Consistent-Hash load-balancer ==================================
+
+func (lb *consistentHashLoadBalancer) register(el *eventloop) {
+	lb.Lock()
+	lb.add(el)
+	// The points of event-loop are derived from its index only,
+	// so every event-loop keeps its own arcs of the ring as the others come and go.
+	ring := make([]ringNode, len(lb.ring), len(lb.ring)+virtualNodes)
+	copy(ring, lb.ring)
+	for i := 0; i < virtualNodes; i++ {
+		ring = append(ring, ringNode{hashKey(strconv.Itoa(el.idx) + "#" + strconv.Itoa(i)), el})
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	lb.ring = ring
+	lb.Unlock()
+}
+
+func (lb *consistentHashLoadBalancer) unregister(el *eventloop) {
+	lb.Lock()
+	lb.remove(el)
+	ring := make([]ringNode, 0, len(lb.ring))
+	for _, node := range lb.ring {
+		if node.el != el {
+			ring = append(ring, node)
+		}
+	}
+	lb.ring = ring
+	lb.Unlock()
+}
+
+// next returns the event-loop owning the first point on the ring clockwise from the hash code of the remote IP.
+func (lb *consistentHashLoadBalancer) next(netAddr net.Addr) *eventloop {
+	h := hashKey(remoteHost(netAddr))
+	lb.RLock()
+	ring := lb.ring
+	lb.RUnlock()
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].el
+}
+
+// hashKey hashes a string with FNV-1a followed by the finalizer of MurmurHash3,
+// which spreads the similar keys like IPs of the same subnet evenly on the ring.
+func hashKey(s string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write(internal.StringToBytes(s))
+	v := h.Sum32()
+	v ^= v >> 16
+	v *= 0x85ebca6b
+	v ^= v >> 13
+	v *= 0xc2b2ae35
+	v ^= v >> 16
+	return v
+}
+
+// remoteHost returns the IP of a remote address without the port, or the whole address if it has no IP.
+func remoteHost(netAddr net.Addr) string {
+	switch addr := netAddr.(type) {
+	case *net.TCPAddr:
+		return string(addr.IP.To16())
+	case *net.UDPAddr:
+		return string(addr.IP.To16())
+	case nil:
+		return ""
+	}
+	return netAddr.String()
+}
+
+// ============================== Implementation of Weighted-Round-Robin load-balancer ===============================
+
+func newWeightedRoundRobinLoadBalancer(weights []int) *weightedRoundRobinLoadBalancer {
+	return &weightedRoundRobinLoadBalancer{weights: weights}
+}
+
+func (lb *weightedRoundRobinLoadBalancer) register(el *eventloop) {
+	lb.Lock()
+	lb.add(el)
+	lb.current = append(lb.current, 0)
+	lb.Unlock()
+}
+
+func (lb *weightedRoundRobinLoadBalancer) unregister(el *eventloop) {
+	lb.Lock()
+	if i := lb.remove(el); i >= 0 {
+		lb.current = append(lb.current[:i], lb.current[i+1:]...)
+	}
+	lb.Unlock()
+}
+
+// weight returns the weight of event-loop.
+func (lb *weightedRoundRobinLoadBalancer) weight(el *eventloop) int {
+	if el.idx >= len(lb.weights) {
+		return 1
+	}
+	if w := lb.weights[el.idx]; w > 0 {
+		return w
+	}
+	return 0
 }
 
-func (lb *sourceAddrHashLoadBalancer) iterate(f func(int, *eventloop) bool) {
+// next returns the eligible event-loop based on Smooth-Weighted-Round-Robin algorithm: every event-loop gains
+// its weight on each pick, and the one with the highest current weight is picked and pays back the total weight.
+func (lb *weightedRoundRobinLoadBalancer) next(_ net.Addr) *eventloop {
+	lb.Lock()
+	defer lb.Unlock()
+	total, best := 0, -1
 	for i, el := range lb.eventLoops {
-		if !f(i, el) {
-			break
+		w := lb.weight(el)
+		lb.current[i] += w
+		total += w
+		if w > 0 && (best < 0 || lb.current[i] > lb.current[best]) {
+			best = i
+		}
+	}
+	if best < 0 {
+		// All event-loops are weighted 0, fall back to weighting them equally.
+		for i := range lb.eventLoops {
+			lb.current[i]++
+			if best < 0 || lb.current[i] > lb.current[best] {
+				best = i
+			}
 		}
+		total = lb.size
+	}
+	lb.current[best] -= total
+	return lb.eventLoops[best]
+}
+
+// ============================== Implementation of Power-of-Two-Choices load-balancer ===============================
+
+// random returns a pseudo-random number, it is safe to be called concurrently by Client.Dial.
+func (lb *powerOfTwoChoicesLoadBalancer) random() uint64 {
+	// SplitMix64 over a Weyl sequence.
+	z := atomic.AddUint64(&lb.seed, 0x9e3779b97f4a7c15)
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// load returns the composite load of event-loop in the unit of connections.
+func (lb *powerOfTwoChoicesLoadBalancer) load(el *eventloop) float64 {
+	return float64(el.ConnCount()) +
+		float64(el.OutboundBytes())/p2cOutboundUnit +
+		float64(el.PendingTasks())/p2cTaskUnit +
+		float64(el.Latency())/float64(p2cLatencyUnit)
+}
+
+// next returns the less loaded one of two distinct event-loops picked at random.
+func (lb *powerOfTwoChoicesLoadBalancer) next(_ net.Addr) *eventloop {
+	lb.RLock()
+	eventLoops := lb.eventLoops
+	lb.RUnlock()
+	size := len(eventLoops)
+	if size == 1 {
+		return eventLoops[0]
+	}
+	r := lb.random()
+	i := int(r % uint64(size))
+	j := int((r >> 32) % uint64(size-1))
+	if j >= i {
+		j++
+	}
+	a, b := eventLoops[i], eventLoops[j]
+	if lb.load(b) < lb.load(a) {
+		return b
+	}
+	return a
+}
+
+// ===================================== Adapter of user-defined load-balancer ======================================
+
+func newCustomLoadBalancer(lb LoadBalancer) *customLoadBalancer {
+	return &customLoadBalancer{lb: lb, registered: make(map[*eventloop]bool)}
+}
+
+func (lb *customLoadBalancer) register(el *eventloop) {
+	lb.Lock()
+	lb.registered[el] = true
+	lb.Unlock()
+	el.idx = lb.lb.Len()
+	lb.lb.Register(el)
+}
+
+func (lb *customLoadBalancer) unregister(el *eventloop) {
+	lb.Lock()
+	delete(lb.registered, el)
+	lb.Unlock()
+	lb.lb.Unregister(el)
+}
+
+// isRegistered reports whether the event-loop has been registered and not retired since.
+func (lb *customLoadBalancer) isRegistered(el *eventloop) bool {
+	lb.RLock()
+	defer lb.RUnlock()
+	return lb.registered[el]
+}
+
+func (lb *customLoadBalancer) next(netAddr net.Addr) *eventloop {
+	if el, ok := lb.lb.Next(netAddr).(*eventloop); ok && lb.isRegistered(el) {
+		return el
 	}
+	// Don't crash the main reactor for a broken load-balancer, take the registered event-loop with the least
+	// connections instead.
+	logging.DefaultLogger.Errorf("custom load-balancer returned an event-loop which was not registered or " +
+		"has been retired, falling back to the one with the least connections")
+	var least *eventloop
+	lb.iterate(func(_ int, el *eventloop) bool {
+		if lb.isRegistered(el) && (least == nil || el.ConnCount() < least.ConnCount()) {
+			least = el
+		}
+		return true
+	})
+	return least
+}
+
+func (lb *customLoadBalancer) iterate(f func(int, *eventloop) bool) {
+	lb.lb.Iterate(func(i int, el EventLoopInfo) bool {
+		if el, ok := el.(*eventloop); ok && el != nil {
+			return f(i, el)
+		}
+		return true
+	})
 }
 
-func (lb *sourceAddrHashLoadBalancer) len() int {
-	return lb.size
+func (lb *customLoadBalancer) len() int {
+	return lb.lb.Len()
 }
 
-func (lb *sourceAddrHashLoadBalancer) calibrate(el *eventloop, delta int32) {
+func (lb *customLoadBalancer) calibrate(el *eventloop, delta int32) {
 	atomic.AddInt32(&el.connCount, delta)
+	lb.lb.Calibrate(el, delta)
 }
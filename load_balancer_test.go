@@ -0,0 +1,190 @@
+// +build linux freebsd dragonfly darwin
+
+package shpnetpoll
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"shpnetpoll/internal/netpoll"
+)
+
+func TestWeightedRoundRobinLoadBalancer(t *testing.T) {
+	lb := newWeightedRoundRobinLoadBalancer([]int{5, 1, 0})
+	for i := 0; i < 4; i++ {
+		lb.register(new(eventloop))
+	}
+
+	picks := make([]int, lb.len())
+	var seq []int
+	for i := 0; i < 70; i++ {
+		el := lb.next(nil)
+		picks[el.idx]++
+		seq = append(seq, el.idx)
+	}
+	if picks[0] != 50 || picks[1] != 10 || picks[2] != 0 || picks[3] != 10 {
+		t.Fatalf("expect picks [50 10 0 10] but got %v", picks)
+	}
+	// Smooth: the heavy event-loop never takes more than its share in a row.
+	for i, run := 0, 0; i < len(seq); i++ {
+		if run = run + 1; i > 0 && seq[i] != seq[i-1] {
+			run = 1
+		}
+		if run > 5 {
+			t.Fatalf("expect event-loops to be interleaved but got %v", seq)
+		}
+	}
+
+	zero := newWeightedRoundRobinLoadBalancer([]int{0, 0})
+	zero.register(new(eventloop))
+	zero.register(new(eventloop))
+	if a, b := zero.next(nil), zero.next(nil); a == b {
+		t.Fatal("expect event-loops weighted 0 to be picked equally")
+	}
+}
+
+func TestConsistentHashLoadBalancer(t *testing.T) {
+	lb := new(consistentHashLoadBalancer)
+	for i := 0; i < 4; i++ {
+		lb.register(new(eventloop))
+	}
+
+	addrs := make([]net.Addr, 1000)
+	before := make([]*eventloop, len(addrs))
+	picks := make([]int, lb.len())
+	for i := range addrs {
+		addrs[i] = &net.TCPAddr{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 40000 + i}
+		before[i] = lb.next(addrs[i])
+		picks[before[i].idx]++
+		other := &net.TCPAddr{IP: addrs[i].(*net.TCPAddr).IP, Port: 50000}
+		if lb.next(other) != before[i] {
+			t.Fatalf("expect the same host to stick to one event-loop regardless of ports: %v", addrs[i])
+		}
+	}
+	for i, n := range picks {
+		if n < 150 || n > 350 {
+			t.Fatalf("expect hosts to be spread evenly but event-loop %d got %d of %d", i, n, len(addrs))
+		}
+	}
+
+	// Only the hosts taken over by the new event-loop are remapped.
+	lb.register(new(eventloop))
+	for i, addr := range addrs {
+		if el := lb.next(addr); el != before[i] && el.idx != 4 {
+			t.Fatalf("expect host %s to stay on event-loop %d or move to the new one but got %d",
+				addr, before[i].idx, el.idx)
+		}
+	}
+
+	if lb.next(&net.UnixAddr{Name: "@client", Net: "unix"}) == nil {
+		t.Fatal("expect a Unix Domain Socket address to be assigned")
+	}
+}
+
+// loadPoller is a poller which only reports the load of event-loop.
+type loadPoller struct {
+	netpoll.Poller
+	pending int
+	latency time.Duration
+}
+
+func (p *loadPoller) PendingTasks() int { return p.pending }
+
+func (p *loadPoller) Latency() time.Duration { return p.latency }
+
+func newLoadedEventLoop(conns int32, outbound int64, p *loadPoller) *eventloop {
+	el := new(eventloop)
+	el.connCount, el.outboundBytes, el.poller = conns, outbound, p
+	return el
+}
+
+func TestPowerOfTwoChoicesLoadBalancer(t *testing.T) {
+	lb := new(powerOfTwoChoicesLoadBalancer)
+	single := newLoadedEventLoop(0, 0, new(loadPoller))
+	lb.register(single)
+	if lb.next(nil) != single {
+		t.Fatal("expect the only event-loop to be picked")
+	}
+
+	// Loads in the unit of connections: 10, 0, 5, 20 and 3.
+	lb = new(powerOfTwoChoicesLoadBalancer)
+	loops := []*eventloop{
+		newLoadedEventLoop(10, 0, new(loadPoller)),
+		newLoadedEventLoop(0, 0, new(loadPoller)),
+		newLoadedEventLoop(0, 5*p2cOutboundUnit, new(loadPoller)),
+		newLoadedEventLoop(0, 0, &loadPoller{latency: 20 * p2cLatencyUnit}),
+		newLoadedEventLoop(0, 0, &loadPoller{pending: 3 * p2cTaskUnit}),
+	}
+	for _, el := range loops {
+		lb.register(el)
+	}
+
+	picks := make([]int, lb.len())
+	for i := 0; i < 10000; i++ {
+		picks[lb.next(nil).idx]++
+	}
+	if picks[3] != 0 {
+		t.Fatalf("expect the event-loop with the highest latency never to be picked but got %v", picks)
+	}
+	// Every pair of event-loops is sampled evenly and won by the less loaded one, so the event-loops win 4/10, 3/10,
+	// 2/10, 1/10 and none of picks in the order of their loads from low to high.
+	for _, want := range [][2]int{{1, 4}, {4, 2}, {2, 0}, {0, 3}} {
+		if picks[want[0]] <= picks[want[1]] {
+			t.Fatalf("expect event-loop %d to be picked more than %d but got %v", want[0], want[1], picks)
+		}
+	}
+	if picks[0] < 800 || picks[0] > 1200 {
+		t.Fatalf("expect event-loop 0 to win about 1/10 of picks but got %v", picks)
+	}
+}
+
+// foreignLoadBalancer is a broken LoadBalancer which returns event-loops of its own.
+type foreignLoadBalancer struct {
+	loops []EventLoopInfo
+}
+
+func (lb *foreignLoadBalancer) Register(el EventLoopInfo) { lb.loops = append(lb.loops, el) }
+
+func (lb *foreignLoadBalancer) Unregister(EventLoopInfo) { lb.loops = lb.loops[:len(lb.loops)-1] }
+
+func (lb *foreignLoadBalancer) Next(net.Addr) EventLoopInfo {
+	return struct{ EventLoopInfo }{lb.loops[0]}
+}
+
+func (lb *foreignLoadBalancer) Iterate(f func(int, EventLoopInfo) bool) {
+	for i, el := range lb.loops {
+		if !f(i, el) {
+			return
+		}
+	}
+}
+
+func (lb *foreignLoadBalancer) Len() int { return len(lb.loops) }
+
+func (lb *foreignLoadBalancer) Calibrate(EventLoopInfo, int32) {}
+
+func TestCustomLoadBalancerFallback(t *testing.T) {
+	lb := newCustomLoadBalancer(new(foreignLoadBalancer))
+	loops := []*eventloop{
+		newLoadedEventLoop(3, 0, new(loadPoller)),
+		newLoadedEventLoop(1, 0, new(loadPoller)),
+		newLoadedEventLoop(2, 0, new(loadPoller)),
+	}
+	for _, el := range loops {
+		lb.register(el)
+	}
+	if el := lb.next(nil); el != loops[1] {
+		t.Fatal("expect the event-loop with the least connections to be picked")
+	}
+
+	// The broken load-balancer still iterates the retired event-loop.
+	lb.unregister(loops[1])
+	if el := lb.next(nil); el != loops[0] {
+		t.Fatal("expect the retired event-loop not to be picked")
+	}
+	lb.unregister(loops[0])
+	if el := lb.next(nil); el != nil {
+		t.Fatalf("expect no event-loop to be picked but got %d", el.idx)
+	}
+}
@@ -27,7 +27,12 @@ func (el *eventloop) handleEvent(fd int, ev uint32) error {
 		// resulting in that it won't receive any responses before the server read all data from client,
 		// in which case if the socket send buffer is full, we need to let it go and continue reading the data
 		// to prevent blocking forever.
-		if ev&netpoll.InEvents != 0 && (ev&netpoll.OutEvents == 0 || c.outboundBuffer.IsEmpty()) {
+		//
+		// An edge-triggered poller won't report the readable event again, so it can never be omitted.
+		// While reading is paused, the connection is still read on errors and hang-ups, which would be reported
+		// over and over again by a level-triggered poller otherwise.
+		if ev&netpoll.InEvents != 0 && c.opened && (!c.isReadPaused() || ev&netpoll.HupEvents != 0) &&
+			(ev&netpoll.OutEvents == 0 || !c.hasPendingOutbound() || el.svr.opts.EdgeTriggered) {
 			return el.loopRead(c)
 		}
 		return nil
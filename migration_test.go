@@ -0,0 +1,224 @@
+// +build linux freebsd dragonfly darwin
+
+package shpnetpoll
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type migrationHandler struct {
+	EventServer
+	started chan Server
+	opened  chan Conn
+	wakes   chan []byte   // replies of wakes in the order they are triggered
+	offload chan struct{} // frames are offloaded to work which echoes them once it's closed, if it's not nil
+}
+
+func newMigrationHandler() *migrationHandler {
+	return &migrationHandler{
+		started: make(chan Server, 1),
+		opened:  make(chan Conn, 64),
+		wakes:   make(chan []byte, 1024),
+	}
+}
+
+func (h *migrationHandler) OnInitComplete(s Server) (action Action) {
+	h.started <- s
+	return
+}
+
+func (h *migrationHandler) OnOpened(c Conn) (out []byte, action Action) {
+	h.opened <- c
+	return
+}
+
+func (h *migrationHandler) React(frame []byte, c Conn) (out []byte, action Action) {
+	if frame == nil {
+		return <-h.wakes, None
+	}
+	if h.offload != nil {
+		if err := c.Offload(frame, func(frame []byte) ([]byte, Action) {
+			<-h.offload
+			return frame, None
+		}); err != nil {
+			return nil, Close
+		}
+	} else {
+		out = append([]byte{}, frame...)
+	}
+	c.ResetBuffer()
+	return
+}
+
+// serveForTest serves the handler on a free local port in background, it returns the server and its address along
+// with the function which stops the server and waits for it.
+func serveForTest(t *testing.T, h *migrationHandler, opts ...Option) (Server, string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	s, stop := serveOnForTest(t, h, "tcp://"+addr, opts...)
+	return s, addr, stop
+}
+
+// serveOnForTest serves the handler on the given address in background like serveForTest.
+func serveOnForTest(t *testing.T, h *migrationHandler, protoAddr string, opts ...Option) (Server, func()) {
+	done := make(chan error, 1)
+	go func() { done <- Serve(h, protoAddr, opts...) }()
+	var s Server
+	select {
+	case s = <-h.started:
+	case err := <-done:
+		t.Fatalf("failed to serve on %s: %v", protoAddr, err)
+	}
+	return s, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = Stop(ctx, protoAddr)
+		<-done
+	}
+}
+
+func dialForTest(t *testing.T, h *migrationHandler, addr string) (net.Conn, Conn) {
+	cli, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case c := <-h.opened:
+		return cli, c
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect the connection to be opened")
+	}
+	return nil, nil
+}
+
+func TestMigrateToKeepsOrder(t *testing.T) {
+	h := newMigrationHandler()
+	_, addr, stop := serveForTest(t, h, WithNumEventLoop(3))
+	defer stop()
+	cli, c := dialForTest(t, h, addr)
+	defer cli.Close()
+
+	// Interleave the writes and wakes with the migrations among all event-loops.
+	var want bytes.Buffer
+	for i := 0; i < 600; i++ {
+		msg := []byte(fmt.Sprintf("%04d", i))
+		want.Write(msg)
+		var err error
+		if i%3 == 0 {
+			h.wakes <- msg
+			err = c.Wake()
+		} else {
+			err = c.AsyncWrite(msg)
+		}
+		if err != nil {
+			t.Fatalf("failed to trigger task %d: %v", i, err)
+		}
+		if i%10 == 9 {
+			if err = c.MigrateTo(i / 10 % 3); err != nil {
+				t.Fatalf("failed to migrate after task %d: %v", i, err)
+			}
+		}
+	}
+
+	got := make([]byte, want.Len())
+	_ = cli.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(cli, got); err != nil {
+		t.Fatalf("expect %d bytes but got %d: %v", want.Len(), len(got), err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Fatalf("expect the writes and wakes in the order they are triggered but got %q", got)
+	}
+
+	cc := c.(*conn)
+	cc.taskMu.Lock()
+	idx := cc.loop.idx
+	cc.taskMu.Unlock()
+	if idx != 599/10%3 {
+		t.Fatalf("expect the connection to end up in event-loop %d but got %d", 599/10%3, idx)
+	}
+}
+
+func TestRebalanceConnections(t *testing.T) {
+	h := newMigrationHandler()
+	s, addr, stop := serveForTest(t, h, WithNumEventLoop(1))
+	defer stop()
+
+	clis := make([]net.Conn, 10)
+	for i := range clis {
+		cli, _ := dialForTest(t, h, addr)
+		defer cli.Close()
+		clis[i] = cli
+	}
+	if err := s.ScaleEventLoops(3); err != nil {
+		t.Fatal(err)
+	}
+	s.RebalanceConnections()
+
+	// The busiest event-loop keeps one connection more than the others.
+	want := []int32{4, 3, 3}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var counts []int32
+		s.svr.lb.iterate(func(i int, el *eventloop) bool {
+			counts = append(counts, el.ConnCount())
+			return true
+		})
+		if fmt.Sprint(counts) == fmt.Sprint(want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect connections to be evened out to %v but got %v", want, counts)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The connections are still served after being migrated.
+	for i, cli := range clis {
+		msg := []byte(fmt.Sprintf("hello %d", i))
+		if _, err := cli.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(msg))
+		_ = cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(cli, got); err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("expect %q to be echoed but got %q: %v", msg, got, err)
+		}
+	}
+}
+
+func TestWakeRepliesAfterOffloads(t *testing.T) {
+	h := newMigrationHandler()
+	h.offload = make(chan struct{})
+	_, addr, stop := serveForTest(t, h)
+	defer stop()
+	cli, c := dialForTest(t, h, addr)
+	defer cli.Close()
+
+	// The frame is offloaded and its reply is held up until the wake has been reacted to.
+	if _, err := cli.Write([]byte("frame")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	h.wakes <- []byte("wake")
+	if err := c.Wake(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(h.offload)
+
+	got := make([]byte, len("framewake"))
+	_ = cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(cli, got); err != nil || string(got) != "framewake" {
+		t.Fatalf("expect the reply of the wake after that of the offloaded frame but got %q: %v", got, err)
+	}
+}
@@ -0,0 +1,168 @@
+// +build linux freebsd dragonfly darwin
+
+package shpnetpoll
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// loopObserver records the latency histograms of event-loop and tracks the callback in progress for the watchdog
+// of slow callbacks, it implements netpoll.Observer.
+type loopObserver struct {
+	goid       int64     // id of the goroutine running the event-loop, kept first for 64-bit alignment
+	eventDelay histogram // delays between the poller returning network-events and handling them
+	callback   histogram // durations of handling network-events
+	task       histogram // durations of running asynchronous tasks
+	el         *eventloop
+	histograms bool          // whether to record the histograms
+	threshold  time.Duration // threshold of slow callbacks, 0 if they are not watched
+	began      time.Time     // when the current callback began, only accessed by the event-loop
+	inTask     bool          // whether the current callback is an asynchronous task, only accessed by the event-loop
+
+	mu       sync.Mutex // guards the fields below, which are shared with the watchdog
+	since    time.Time  // when the current callback began, zero if there is none
+	fd       int        // fd of the current network-event, -1 for an asynchronous task
+	remote   net.Addr   // remote address of the connection of fd, nil if fd is not a connection
+	reported bool       // whether the current callback has been reported as a slow one
+}
+
+func newLoopObserver(el *eventloop) *loopObserver {
+	opts := el.svr.opts
+	if !opts.LatencyHistograms && opts.SlowCallbackThreshold <= 0 {
+		return nil
+	}
+	o := &loopObserver{el: el, histograms: opts.LatencyHistograms}
+	if opts.SlowCallbackThreshold > 0 {
+		o.threshold = opts.SlowCallbackThreshold
+	}
+	return o
+}
+
+// bind records the goroutine running the event-loop, it's called by the event-loop before polling.
+func (o *loopObserver) bind() {
+	atomic.StoreInt64(&o.goid, currentGoroutineID())
+}
+
+// BeginEvent implements netpoll.Observer.
+func (o *loopObserver) BeginEvent(fd int, polled time.Time) {
+	now := time.Now()
+	o.began, o.inTask = now, false
+	if o.histograms {
+		o.eventDelay.observe(now.Sub(polled))
+	}
+	if o.threshold > 0 {
+		var remote net.Addr
+		if c, ok := o.el.connections[fd]; ok {
+			remote = c.remoteAddr
+		}
+		o.watch(now, fd, remote)
+	}
+}
+
+// BeginTask implements netpoll.Observer.
+func (o *loopObserver) BeginTask() {
+	now := time.Now()
+	o.began, o.inTask = now, true
+	if o.threshold > 0 {
+		o.watch(now, -1, nil)
+	}
+}
+
+// End implements netpoll.Observer.
+func (o *loopObserver) End() {
+	if o.histograms {
+		if d := time.Since(o.began); o.inTask {
+			o.task.observe(d)
+		} else {
+			o.callback.observe(d)
+		}
+	}
+	if o.threshold > 0 {
+		o.watch(time.Time{}, 0, nil)
+	}
+}
+
+func (o *loopObserver) watch(since time.Time, fd int, remote net.Addr) {
+	o.mu.Lock()
+	o.since, o.fd, o.remote, o.reported = since, fd, remote, false
+	o.mu.Unlock()
+}
+
+// check warns about the callback in progress once it has been running for longer than the threshold,
+// it's called by the watchdog.
+func (o *loopObserver) check() {
+	o.mu.Lock()
+	elapsed := time.Since(o.since)
+	if o.since.IsZero() || o.reported || elapsed <= o.threshold {
+		o.mu.Unlock()
+		return
+	}
+	o.reported = true
+	fd, remote := o.fd, o.remote
+	o.mu.Unlock()
+
+	callback := "an asynchronous task"
+	if fd >= 0 {
+		callback = fmt.Sprintf("the callback of fd=%d (remote addr: %v)", fd, remote)
+	}
+	o.el.svr.logger.Warnf("event-loop(%d) has been blocked by %s for %v, stack:\n%s",
+		o.el.idx, callback, elapsed, goroutineStack(atomic.LoadInt64(&o.goid)))
+}
+
+// watchSlowCallbacks checks the callbacks of event-loops periodically until the server is shut down.
+func (svr *server) watchSlowCallbacks() {
+	interval := svr.opts.SlowCallbackThreshold / 4
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if svr.isInShutdown() {
+			return
+		}
+		svr.lb.iterate(func(i int, el *eventloop) bool {
+			el.observer.check()
+			return true
+		})
+	}
+}
+
+// currentGoroutineID parses the id of the current goroutine from the header of its stack, "goroutine 18 [running]:".
+func currentGoroutineID() int64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	if i := bytes.IndexByte(buf, ' '); i > 0 {
+		buf = buf[:i]
+	}
+	id, _ := strconv.ParseInt(string(buf), 10, 64)
+	return id
+}
+
+// goroutineStack returns the stack of the goroutine with the given id.
+func goroutineStack(id int64) []byte {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= 64<<20 {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	header := []byte(fmt.Sprintf("goroutine %d [", id))
+	for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+		if bytes.HasPrefix(stack, header) {
+			return stack
+		}
+	}
+	return nil
+}
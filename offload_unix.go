@@ -0,0 +1,164 @@
+// +build linux freebsd dragonfly darwin
+
+package shpnetpoll
+
+import (
+	"runtime/debug"
+	"sync/atomic"
+
+	"shpnetpoll/errors"
+	"shpnetpoll/pool/goroutine"
+)
+
+// offloadReply is the reply of a frame offloaded to the worker pool, or of a frame reacted to behind such one,
+// which waits for the replies of the frames before it to be written.
+type offloadReply struct {
+	out    []byte
+	action Action
+	done   bool
+}
+
+// workerPool returns the worker pool of offloaded frames, which is created on the first use.
+func (svr *server) workerPool() (*goroutine.Pool, error) {
+	svr.workersOnce.Do(func() {
+		size := svr.opts.WorkerPoolSize
+		if size <= 0 {
+			size = goroutine.DefaultAntsPoolSize
+		}
+		svr.workers, svr.workersErr = goroutine.New(size)
+	})
+	return svr.workers, svr.workersErr
+}
+
+// releaseWorkerPool releases the worker pool once the event-loops are all exited.
+func (svr *server) releaseWorkerPool() {
+	svr.workersOnce.Do(func() {})
+	if svr.workers != nil {
+		svr.workers.Release()
+	}
+}
+
+// runOffload runs the work of an offloaded frame, a panic in it closes the connection instead of crashing the server.
+func (svr *server) runOffload(work func(frame []byte) ([]byte, Action), frame []byte) (out []byte, action Action) {
+	defer func() {
+		if p := recover(); p != nil {
+			svr.logger.Errorf("offloaded work panicked, closing the connection: %v\n%s", p, debug.Stack())
+			out, action = nil, Close
+		}
+	}()
+	return work(frame)
+}
+
+// offloadsFull reports whether the connection has as many offloaded frames in flight as allowed.
+func (c *conn) offloadsFull() bool {
+	limit := c.loop.svr.opts.MaxInflightOffloads
+	return limit > 0 && c.inflight >= limit
+}
+
+// loopReply writes the reply of a frame reacted to, or queues it up behind the replies of the frames offloaded before.
+func (el *eventloop) loopReply(c *conn, out []byte, action Action) error {
+	if len(c.replies) > 0 {
+		c.replies = append(c.replies, &offloadReply{out: out, action: action, done: true})
+		return nil
+	}
+	if out != nil {
+		el.eventHandler.PreWrite()
+		// Encode data and try to write it back to the client, this attempt is based on a fact:
+		// a client socket waits for the response data after sending request data to the server,
+		// which makes the client socket writable.
+		if err := c.write(out); err != nil || !c.opened {
+			return err
+		}
+	}
+	return el.handleAction(c, action)
+}
+
+// loopOffloadDone records the reply of an offloaded frame and writes the replies which are ready in order.
+func (el *eventloop) loopOffloadDone(c *conn, r *offloadReply, out []byte, action Action) error {
+	paused := c.isReadPaused()
+	c.inflight--
+	atomic.AddInt64(&el.counters.inflightOffloads, -1)
+	r.out, r.action, r.done = out, action, true
+	if !c.opened {
+		return nil
+	}
+
+	for len(c.replies) > 0 && c.replies[0].done {
+		r = c.replies[0]
+		c.replies[0] = nil
+		c.replies = c.replies[1:]
+		if r.out != nil {
+			el.eventHandler.PreWrite()
+			if err := c.write(r.out); err != nil || !c.opened {
+				return err
+			}
+		}
+		if err := el.handleAction(c, r.action); err != nil || !c.opened {
+			return err
+		}
+	}
+	if len(c.replies) == 0 {
+		c.replies = nil
+	}
+
+	// Go on with the frames left in buffers when the in-flight limit was reached.
+	if paused && !c.isReadPaused() {
+		if err := el.loopReactPending(c); err != nil || !c.opened || c.isReadPaused() {
+			return err
+		}
+		return el.watchRead(c)
+	}
+	return nil
+}
+
+// loopReactPending fires React on the frames left in buffers when the in-flight limit of offloads was reached,
+// once reading from the connection is resumed.
+func (el *eventloop) loopReactPending(c *conn) error {
+	if !c.opened || !c.reactPending || c.isReadPaused() {
+		return nil
+	}
+	// The data read last time are all in the inbound buffer now.
+	c.buffer = nil
+	if err := el.loopReact(c); err != nil || !c.opened {
+		return err
+	}
+	c.accountInbound(c.inboundBuffer.Length())
+	return nil
+}
+
+func (c *conn) Offload(frame []byte, work func(frame []byte) (out []byte, action Action)) error {
+	if !c.opened {
+		return nil
+	}
+	el, svr := c.loop, c.loop.svr
+	pool, err := svr.workerPool()
+	if err != nil {
+		return err
+	}
+
+	r := new(offloadReply)
+	frame = append([]byte(nil), frame...)
+	if err = pool.Submit(func() {
+		out, action := svr.runOffload(work, frame)
+		_ = c.triggerUrgent(func(loop *eventloop) error {
+			return loop.loopOffloadDone(c, r, out, action)
+		})
+	}); err != nil {
+		atomic.AddUint64(&svr.offloadsRejected, 1)
+		if err == goroutine.ErrPoolOverload {
+			err = errors.ErrWorkerPoolOverload
+		}
+		return err
+	}
+
+	// The reply is recorded in a task after this, since the worker triggers it in the event-loop.
+	paused := c.isReadPaused()
+	c.replies = append(c.replies, r)
+	c.inflight++
+	atomic.AddUint64(&el.counters.offloads, 1)
+	atomic.AddInt64(&el.counters.inflightOffloads, 1)
+	if !paused && c.isReadPaused() {
+		return el.watchRead(c)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package shpnetpoll
 
 import (
+	"os"
 	"time"
 
 	"shpnetpoll/internal/logging"
@@ -26,6 +27,34 @@ const (
 	TCPDelay
 )
 
+// PollerType is the type of mechanism used by event-loops to monitor file-descriptors.
+type PollerType int
+
+// Available pollers.
+const (
+	// EpollPoller monitors file-descriptors with epoll, it falls back to PollPoller
+	// when epoll or eventfd is not allowed.
+	EpollPoller PollerType = iota
+	// IOUringPoller accepts connections, receives from and sends to them with the requests of io_uring, using buffers
+	// of ReadBufferCap bytes registered to the ring, and submits the requests along with the wait in one syscall.
+	// The other file-descriptors, and the connections while the registered buffers run out, are watched by
+	// the one-shot poll requests of io_uring. It falls back to EpollPoller when io_uring is not supported by the kernel
+	// (Linux 5.5+ is required), and to the poll requests alone on a kernel older than 5.7.
+	IOUringPoller
+	// PollPoller monitors file-descriptors with poll(2) and wakes up with a self-pipe, it is meant
+	// for restricted sandboxes since it doesn't scale with the number of connections as well as epoll.
+	PollPoller
+)
+
+// UnixSocketOwner is the ownership assigned to the socket file of a Unix Domain Socket listener.
+type UnixSocketOwner struct {
+	// UID is the numeric user id of the owner, -1 leaves it unchanged.
+	UID int
+
+	// GID is the numeric group id of the owner, -1 leaves it unchanged.
+	GID int
+}
+
 // Options are set when the client opens.
 type Options struct {
 	// Multicore indicates whether the server will be effectively created with multi-cores, if so,
@@ -40,6 +69,23 @@ type Options struct {
 	// potential higher performance.
 	LockOSThread bool
 
+	// CPUAffinity is the list of CPUs to pin event-loops on, the event-loop with index i is pinned on
+	// CPUAffinity[i%len(CPUAffinity)] via sched_setaffinity(2), which implies LockOSThread for event-loops.
+	// In ReusePort mode, the listener of every event-loop is set up with SO_INCOMING_CPU as well, so that
+	// the kernel prefers it for the connections received on the same CPU.
+	// It only works on Linux, event-loops are left unpinned if it fails.
+	CPUAffinity []int
+
+	// LatencyHistograms is used to determine whether to record per-loop histograms of the delays between the poller
+	// returning network-events and handling them, the durations of handling network-events and the durations of
+	// asynchronous tasks, they are reported by Server.Stats and Server.MetricsHandler.
+	LatencyHistograms bool
+
+	// SlowCallbackThreshold is the duration beyond which a single callback or asynchronous task running in
+	// an event-loop is considered slow, a warning with the fd, remote address and stack of the event-loop is logged
+	// once for every slow one. It's disabled if it's not positive.
+	SlowCallbackThreshold time.Duration
+
 	// ReadBufferCap is the maximum number of bytes that can be read from the client when the readable event comes.
 	// The default value is 16KB, it can be reduced to avoid starving subsequent client connections.
 	//
@@ -47,22 +93,95 @@ type Options struct {
 	// or equal to its real amount.
 	ReadBufferCap int
 
+	// OutboundHighWatermark is the number of bytes in the outbound buffer of connection beyond which the connection
+	// becomes unwritable: reading from it is paused and OnWritabilityChanged of EventHandler fires, until the buffer is
+	// drained to OutboundLowWatermark, at which point reading is resumed and OnWritabilityChanged fires again.
+	// It's disabled if it's not positive.
+	OutboundHighWatermark int
+
+	// OutboundLowWatermark is the number of bytes in the outbound buffer of connection to which the buffer must be
+	// drained before an unwritable connection becomes writable again, it defaults to half of OutboundHighWatermark
+	// if it's not positive or exceeds OutboundHighWatermark.
+	OutboundLowWatermark int
+
+	// MaxInboundBuffer is the maximum number of bytes buffered for the incomplete frames of connection, the connection
+	// is closed with errors.ErrInboundBufferExceeded once it's exceeded. It's unlimited if it's not positive.
+	MaxInboundBuffer int
+
+	// MaxOutboundBuffer is the maximum number of bytes waiting in the outbound buffer of connection, the connection
+	// is closed with errors.ErrOutboundBufferExceeded once it's exceeded. It's unlimited if it's not positive.
+	MaxOutboundBuffer int
+
+	// MemoryBudget is the maximum number of bytes buffered by the inbound and outbound buffers of all connections,
+	// the connection whose buffer grows beyond it is closed with errors.ErrMemoryBudgetExceeded.
+	// It's unlimited if it's not positive.
+	MemoryBudget int64
+
+	// WorkerPoolSize is the maximum number of workers running the frames offloaded by Conn.Offload,
+	// the default value is goroutine.DefaultAntsPoolSize.
+	WorkerPoolSize int
+
+	// MaxInflightOffloads is the maximum number of frames offloaded by Conn.Offload waiting for their replies on
+	// a connection, no more frames are decoded or read from the connection until some of them are replied.
+	// It's unlimited if it's not positive.
+	MaxInflightOffloads int
+
+	// AsyncTaskQueueCapacity is the maximum number of asynchronous tasks waiting in the queue of every event-loop,
+	// AsyncWrite, Wake, etc. fail with errors.ErrAsyncTaskQueueFull once it's reached. Control tasks, such as Close
+	// and shutting down the server, are queued up in a separate high-priority lane which is never full and runs ahead,
+	// though Close still closes the connection after the asynchronous writes triggered before it.
+	// It's unbounded if it's not positive.
+	AsyncTaskQueueCapacity int
+
 	// LB represents the load-balancing algorithm used when assigning new connections.
 	LB LoadBalancing
 
+	// LBWeights are the weights of event-loops in the order of their indexes for WeightedRoundRobin,
+	// event-loops without a weight specified are weighted 1.
+	LBWeights []int
+
+	// CustomLB is the user-defined load-balancer used when assigning new connections, it overrides LB if set.
+	CustomLB LoadBalancer
+
 	// NumEventLoop is set up to start the given number of event-loop goroutine.
 	// Note: Setting up NumEventLoop will override Multicore.
 	NumEventLoop int
 
 	// ReusePort indicates whether to set up the SO_REUSEPORT socket option.
+	// For UDP servers, every event-loop binds its own socket when it is enabled, so that the kernel
+	// fans incoming datagrams out across all event-loops.
 	ReusePort bool
 
+	// UnixSocketMode sets up the file mode of the socket file created by a Unix Domain Socket listener,
+	// the zero value keeps the mode derived from the process umask.
+	// It is ignored for addresses in the Linux abstract namespace.
+	UnixSocketMode os.FileMode
+
+	// UnixSocketOwner sets up the ownership of the socket file created by a Unix Domain Socket listener,
+	// nil keeps the owner of the current process.
+	// It is ignored for addresses in the Linux abstract namespace.
+	UnixSocketOwner *UnixSocketOwner
+
+	// Poller is the mechanism used by event-loops to monitor file-descriptors, EpollPoller by default.
+	Poller PollerType
+
+	// EdgeTriggered registers connections to the poller in edge-triggered mode (EPOLLET) for both readable and
+	// writable events once and for all, which saves the epoll_ctl calls of switching the writable events on and off
+	// around every partial write. Connections are read until EAGAIN on every readable event, with a budget of reads
+	// to keep being fair to other connections of the same event-loop. Listeners are always level-triggered.
+	// It only works with EpollPoller and is turned off for other pollers.
+	EdgeTriggered bool
+
 	// Ticker indicates whether the ticker has been set up.
 	Ticker bool
 
 	// TCPKeepAlive sets up a duration for (SO_KEEPALIVE) socket option.
 	TCPKeepAlive time.Duration
 
+	// IdleTimeout closes the connections which neither read nor write any data for the given duration,
+	// the error passed to OnClosed is errors.ErrIdleTimeout. It is disabled when the value is not positive.
+	IdleTimeout time.Duration
+
 	// TCPNoDelay controls whether the operating system should delay
 	// packet transmission in hopes of sending fewer packets (Nagle's algorithm).
 	//
@@ -99,6 +218,27 @@ func WithLockOSThread(lockOSThread bool) Option {
 	}
 }
 
+// WithCPUAffinity sets up the CPUs to pin event-loops on.
+func WithCPUAffinity(cpus []int) Option {
+	return func(opts *Options) {
+		opts.CPUAffinity = cpus
+	}
+}
+
+// WithLatencyHistograms sets up LatencyHistograms for recording the latency histograms of event-loops.
+func WithLatencyHistograms(latencyHistograms bool) Option {
+	return func(opts *Options) {
+		opts.LatencyHistograms = latencyHistograms
+	}
+}
+
+// WithSlowCallbackThreshold sets up SlowCallbackThreshold for warning about slow callbacks.
+func WithSlowCallbackThreshold(threshold time.Duration) Option {
+	return func(opts *Options) {
+		opts.SlowCallbackThreshold = threshold
+	}
+}
+
 // WithReadBufferCap sets up ReadBufferCap for reading bytes.
 func WithReadBufferCap(readBufferCap int) Option {
 	return func(opts *Options) {
@@ -106,6 +246,56 @@ func WithReadBufferCap(readBufferCap int) Option {
 	}
 }
 
+// WithOutboundWatermarks sets up OutboundLowWatermark and OutboundHighWatermark for the backpressure of connections.
+func WithOutboundWatermarks(low, high int) Option {
+	return func(opts *Options) {
+		opts.OutboundLowWatermark = low
+		opts.OutboundHighWatermark = high
+	}
+}
+
+// WithMaxInboundBuffer sets up MaxInboundBuffer for limiting the inbound buffer of every connection.
+func WithMaxInboundBuffer(maxInboundBuffer int) Option {
+	return func(opts *Options) {
+		opts.MaxInboundBuffer = maxInboundBuffer
+	}
+}
+
+// WithMaxOutboundBuffer sets up MaxOutboundBuffer for limiting the outbound buffer of every connection.
+func WithMaxOutboundBuffer(maxOutboundBuffer int) Option {
+	return func(opts *Options) {
+		opts.MaxOutboundBuffer = maxOutboundBuffer
+	}
+}
+
+// WithMemoryBudget sets up MemoryBudget for limiting the buffers of all connections.
+func WithMemoryBudget(memoryBudget int64) Option {
+	return func(opts *Options) {
+		opts.MemoryBudget = memoryBudget
+	}
+}
+
+// WithWorkerPoolSize sets up WorkerPoolSize for the worker pool of offloaded frames.
+func WithWorkerPoolSize(workerPoolSize int) Option {
+	return func(opts *Options) {
+		opts.WorkerPoolSize = workerPoolSize
+	}
+}
+
+// WithMaxInflightOffloads sets up MaxInflightOffloads for limiting the offloaded frames of every connection.
+func WithMaxInflightOffloads(maxInflightOffloads int) Option {
+	return func(opts *Options) {
+		opts.MaxInflightOffloads = maxInflightOffloads
+	}
+}
+
+// WithAsyncTaskQueueCapacity sets up AsyncTaskQueueCapacity for bounding the asynchronous tasks of event-loops.
+func WithAsyncTaskQueueCapacity(asyncTaskQueueCapacity int) Option {
+	return func(opts *Options) {
+		opts.AsyncTaskQueueCapacity = asyncTaskQueueCapacity
+	}
+}
+
 // WithLoadBalancing sets up the load-balancing algorithm in gnet server.
 func WithLoadBalancing(lb LoadBalancing) Option {
 	return func(opts *Options) {
@@ -113,6 +303,20 @@ func WithLoadBalancing(lb LoadBalancing) Option {
 	}
 }
 
+// WithLoadBalancingWeights sets up the weights of event-loops for WeightedRoundRobin.
+func WithLoadBalancingWeights(weights ...int) Option {
+	return func(opts *Options) {
+		opts.LBWeights = weights
+	}
+}
+
+// WithCustomLoadBalancer sets up the user-defined load-balancer in gnet server, which overrides WithLoadBalancing.
+func WithCustomLoadBalancer(lb LoadBalancer) Option {
+	return func(opts *Options) {
+		opts.CustomLB = lb
+	}
+}
+
 // WithNumEventLoop sets up NumEventLoop in gnet server.
 func WithNumEventLoop(numEventLoop int) Option {
 	return func(opts *Options) {
@@ -127,6 +331,20 @@ func WithReusePort(reusePort bool) Option {
 	}
 }
 
+// WithUnixSocketMode sets up the file mode of the Unix Domain Socket file.
+func WithUnixSocketMode(mode os.FileMode) Option {
+	return func(opts *Options) {
+		opts.UnixSocketMode = mode
+	}
+}
+
+// WithUnixSocketOwner sets up the ownership of the Unix Domain Socket file.
+func WithUnixSocketOwner(uid, gid int) Option {
+	return func(opts *Options) {
+		opts.UnixSocketOwner = &UnixSocketOwner{UID: uid, GID: gid}
+	}
+}
+
 // WithTCPKeepAlive sets up the SO_KEEPALIVE socket option with duration.
 func WithTCPKeepAlive(tcpKeepAlive time.Duration) Option {
 	return func(opts *Options) {
@@ -134,6 +352,13 @@ func WithTCPKeepAlive(tcpKeepAlive time.Duration) Option {
 	}
 }
 
+// WithIdleTimeout sets up the idle timeout of connections.
+func WithIdleTimeout(idleTimeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.IdleTimeout = idleTimeout
+	}
+}
+
 // WithTCPNoDelay enable/disable the TCP_NODELAY socket option.
 func WithTCPNoDelay(tcpNoDelay TCPSocketOpt) Option {
 	return func(opts *Options) {
@@ -141,6 +366,20 @@ func WithTCPNoDelay(tcpNoDelay TCPSocketOpt) Option {
 	}
 }
 
+// WithPoller sets up the poller of event-loops.
+func WithPoller(poller PollerType) Option {
+	return func(opts *Options) {
+		opts.Poller = poller
+	}
+}
+
+// WithEdgeTriggered sets up the edge-triggered mode for connections.
+func WithEdgeTriggered(edgeTriggered bool) Option {
+	return func(opts *Options) {
+		opts.EdgeTriggered = edgeTriggered
+	}
+}
+
 // WithTicker indicates that a ticker is set.
 func WithTicker(ticker bool) Option {
 	return func(opts *Options) {
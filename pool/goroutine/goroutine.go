@@ -46,9 +46,17 @@ func init() {
 // Pool is the alias of ants.Pool.
 type Pool = ants.Pool
 
+// ErrPoolOverload is returned when submitting a task to a full non-blocking pool.
+var ErrPoolOverload = ants.ErrPoolOverload
+
 // Default instantiates a non-blocking *WorkerPool with the capacity of DefaultAntsPoolSize.
 func Default() *Pool {
-	options := ants.Options{ExpiryDuration: ExpiryDuration, Nonblocking: Nonblocking}
-	defaultAntsPool, _ := ants.NewPool(DefaultAntsPoolSize, ants.WithOptions(options))
+	defaultAntsPool, _ := New(DefaultAntsPoolSize)
 	return defaultAntsPool
 }
+
+// New instantiates a non-blocking *WorkerPool with the given capacity.
+func New(size int) (*Pool, error) {
+	options := ants.Options{ExpiryDuration: ExpiryDuration, Nonblocking: Nonblocking}
+	return ants.NewPool(size, ants.WithOptions(options))
+}
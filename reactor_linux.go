@@ -19,20 +19,36 @@ func (svr *server) activateMainReactor(lockOSThread bool) {
 }
 
 func (svr *server) activateSubReactor(el *eventloop, lockOSThread bool) {
-	if lockOSThread {
-		runtime.LockOSThread()
-		defer runtime.UnlockOSThread()
-	}
+	defer close(el.exited)
+	defer el.lockOSThread(lockOSThread)()
 
 	defer func() {
 		el.closeAllConns()
+		if el.retired {
+			// A retired event-loop exits alone without shutting down the server.
+			sniffErrorAndLog(el.poller.Close())
+			svr.retireStats(el)
+			return
+		}
 		svr.signalShutdown()
 	}()
 
+	if el.observer != nil {
+		el.observer.bind()
+	}
+
 	// 副reactor池负责读写操作，
 	// Polling函数中进行循环处理读写事件
 	err := el.poller.Polling(func(fd int, ev uint32) error {
 		if c, ack := el.connections[fd]; ack {
+			// A client connection reports the outcome of its non-blocking connect by a writable event,
+			// go on handling the same event after it's opened since an edge-triggered poller won't report it again.
+			if c.connecting {
+				if err := el.loopConnect(c); err != nil || !c.opened {
+					return err
+				}
+			}
+
 			// Don't change the ordering of processing EPOLLOUT | EPOLLRDHUP / EPOLLIN unless you're 100%
 			// sure what you're doing!
 			// Re-ordering can easily introduce bugs and bad side-effects, as I found out painfully in the past.
@@ -58,7 +74,12 @@ func (svr *server) activateSubReactor(el *eventloop, lockOSThread bool) {
 			// resulting in that it won't receive any responses before the server read all data from client,
 			// in which case if the socket send buffer is full, we need to let it go and continue reading the data
 			// to prevent blocking forever.
-			if ev&netpoll.InEvents != 0 && (ev&netpoll.OutEvents == 0 || c.outboundBuffer.IsEmpty()) {
+			//
+			// An edge-triggered poller won't report the readable event again, so it can never be omitted.
+			// While reading is paused, the connection is still read on errors and hang-ups, which would be reported
+			// over and over again by a level-triggered poller otherwise.
+			if ev&netpoll.InEvents != 0 && c.opened && (!c.isReadPaused() || ev&netpoll.HupEvents != 0) &&
+				(ev&netpoll.OutEvents == 0 || !c.hasPendingOutbound() || el.svr.opts.EdgeTriggered) {
 				return el.loopRead(c)
 			}
 		}
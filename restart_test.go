@@ -0,0 +1,98 @@
+// +build linux freebsd dragonfly darwin
+
+package shpnetpoll
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// inheritForTest makes the current process look like one started by Restart, which inherits the given fds.
+// It returns the read end of the pipe that readiness is reported through.
+func inheritForTest(t *testing.T, fds map[string][]int) *os.File {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, _ := json.Marshal(fds)
+	wfd, err := unix.Dup(int(w.Fd()))
+	_ = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Setenv(envInheritedListeners, string(desc))
+	_ = os.Setenv(envRestartReadyFd, strconv.Itoa(wfd))
+	inherited.once, inherited.fds = sync.Once{}, nil
+	return r
+}
+
+// listenerFdForTest returns a duplicate of the fd of a new TCP listener, as the one handed over by the parent.
+func listenerFdForTest(t *testing.T) (net.Listener, int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd, err := unix.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln, fd
+}
+
+// readyForTest reports whether readiness is reported through the pipe within the timeout.
+func readyForTest(r *os.File, timeout time.Duration) bool {
+	_ = r.SetReadDeadline(time.Now().Add(timeout))
+	b := make([]byte, 1)
+	n, _ := r.Read(b)
+	return n == 1
+}
+
+func TestRestartReadyAfterAllAddressesServed(t *testing.T) {
+	lnA, fdA := listenerFdForTest(t)
+	lnB, fdB := listenerFdForTest(t)
+	addrA, addrB := lnA.Addr().String(), lnB.Addr().String()
+	r := inheritForTest(t, map[string][]int{"tcp://" + addrA: {fdA}, "tcp://" + addrB: {fdB}})
+	defer r.Close()
+
+	// A client waits in the accept queue of B while the new process is starting.
+	cli, err := net.Dial("tcp", addrB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	hA := newMigrationHandler()
+	_, stopA := serveOnForTest(t, hA, "tcp://"+addrA)
+	defer stopA()
+	if readyForTest(r, 500*time.Millisecond) {
+		t.Fatal("expect readiness not to be reported before all inherited addresses are served")
+	}
+
+	hB := newMigrationHandler()
+	_, stopB := serveOnForTest(t, hB, "tcp://"+addrB)
+	defer stopB()
+	if !readyForTest(r, 5*time.Second) {
+		t.Fatal("expect readiness to be reported once all inherited addresses are served")
+	}
+
+	// The parent closes its copies of listeners once the new process is ready.
+	_ = lnA.Close()
+	_ = lnB.Close()
+	select {
+	case <-hB.opened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect the connection waiting in the accept queue to be served by the new process")
+	}
+}
@@ -0,0 +1,250 @@
+// +build linux freebsd dragonfly darwin
+
+package shpnetpoll
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+	"shpnetpoll/errors"
+	"shpnetpoll/internal/logging"
+)
+
+const (
+	// envInheritedListeners describes the listener fds handed over to the new process on hot restart,
+	// it is a JSON object which maps "network://addr" to the fds.
+	envInheritedListeners = "GNET_INHERITED_LISTENERS"
+	// envRestartReadyFd is the fd of the pipe through which the new process reports that it has taken over the listeners.
+	envRestartReadyFd = "GNET_RESTART_READY_FD"
+)
+
+// inherited holds the listener fds that the current process inherited from its parent on hot restart.
+var inherited struct {
+	once    sync.Once
+	mu      sync.Mutex
+	fds     map[string][]int // fds of the addresses which have not been served yet
+	readyFd int              // fd to report the readiness to parent, -1 if there is no parent waiting
+}
+
+// loadInherited parses the listener fds inherited from parent, the environments are unset so that they won't leak
+// into the other processes started by the current one.
+func loadInherited() {
+	inherited.readyFd = -1
+	if v, ok := os.LookupEnv(envInheritedListeners); ok {
+		_ = os.Unsetenv(envInheritedListeners)
+		if err := json.Unmarshal([]byte(v), &inherited.fds); err != nil {
+			logging.DefaultLogger.Errorf("invalid %s: %v", envInheritedListeners, err)
+		}
+	}
+	if v, ok := os.LookupEnv(envRestartReadyFd); ok {
+		_ = os.Unsetenv(envRestartReadyFd)
+		if fd, err := strconv.Atoi(v); err == nil {
+			inherited.readyFd = fd
+		}
+	}
+}
+
+// inheritedKey returns the key by which the listener fds of the given address are handed over on hot restart,
+// the sockets passed in by a supervisor are keyed by the address of fd or listen-fds network they are served on.
+func inheritedKey(network, addr string) string {
+	if n := canonicalNetwork(network); n != "" {
+		network = n
+	}
+	return network + "://" + addr
+}
+
+// takeInheritedFd takes one of the listener fds inherited from parent for the given address.
+func takeInheritedFd(network, addr string) (int, bool) {
+	inherited.once.Do(loadInherited)
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+
+	key := inheritedKey(network, addr)
+	fds := inherited.fds[key]
+	if len(fds) == 0 {
+		return 0, false
+	}
+	inherited.fds[key] = fds[1:]
+	return fds[0], true
+}
+
+// takeSpareInheritedFds takes all the listener fds inherited from parent for the given address which are left,
+// they are left when the current process runs fewer event-loops than its parent in ReusePort mode.
+func takeSpareInheritedFds(network, addr string) []int {
+	inherited.once.Do(loadInherited)
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+
+	key := inheritedKey(network, addr)
+	fds := inherited.fds[key]
+	delete(inherited.fds, key)
+	return fds
+}
+
+// adoptSpareListeners makes the running event-loops watch the spare listener fds inherited from parent for the
+// addresses of server. They can't be closed, the parent closes its copies once the current process is ready,
+// and closing the last reference to a socket resets all connections waiting in its accept queue.
+func (svr *server) adoptSpareListeners() {
+	var i int
+	for _, ln := range svr.lns {
+		for _, fd := range takeSpareInheritedFds(ln.network, ln.addr) {
+			l, err := fileListener(ln.network, ln.addr, fd, svr.opts)
+			if err != nil {
+				svr.logger.Errorf("failed to adopt the spare listener fd=%d inherited for %s://%s: %v",
+					fd, ln.network, ln.addr, err)
+				_ = unix.Close(fd)
+				continue
+			}
+			el := svr.mainLoop
+			if el == nil {
+				// Spread them over the event-loops, which run in the same way as with listeners of their own.
+				if el = svr.eventLoopAt(i % svr.lb.len()); el == nil {
+					el = svr.eventLoopAt(0)
+				}
+				i++
+			}
+			sniffErrorAndLog(el.poller.UrgentTrigger(func() error {
+				return el.addListener(l)
+			}))
+		}
+	}
+}
+
+// notifyRestartReady reports to parent that the current process has started serving, once all the addresses of
+// inherited listeners are served, the spare fds of an address are taken by the server serving it.
+func notifyRestartReady() {
+	inherited.once.Do(loadInherited)
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+
+	if inherited.readyFd < 0 || len(inherited.fds) > 0 {
+		return
+	}
+	_, _ = unix.Write(inherited.readyFd, []byte{1})
+	_ = unix.Close(inherited.readyFd)
+	inherited.readyFd = -1
+}
+
+// Restart hands the listeners of all servers in the current process over to a new process,
+// and then stops the servers gracefully as Stop does.
+//
+// The new process is started from the same executable with the same arguments and environments, it adopts the
+// listening sockets when calling Serve with the same protoAddrs instead of creating new ones, so the connections
+// waiting in the accept queues are not dropped. Restart starts draining only after the new process has started
+// serving all of them, it kills the new process and returns an error if that doesn't happen until ctx is done.
+//
+// It returns the pid of the new process.
+func Restart(ctx context.Context) (pid int, err error) {
+	var (
+		protoAddrs []string
+		lns        []*listener
+		seen       = make(map[*server]bool)
+	)
+	// A server served on multiple addresses is stored in serverFarm once per address, stop it by any one of them.
+	serverFarm.Range(func(key, value interface{}) bool {
+		if svr := value.(*server); !svr.isInShutdown() && !seen[svr] {
+			seen[svr] = true
+			protoAddrs = append(protoAddrs, key.(string))
+			lns = append(lns, svr.listeners()...)
+		}
+		return true
+	})
+	if len(protoAddrs) == 0 {
+		return 0, errors.ErrServerInShutdown
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	fds := make(map[string][]int)
+	for _, ln := range lns {
+		fd, sc, err := ln.Dup()
+		if err != nil {
+			return 0, os.NewSyscallError(sc, err)
+		}
+		files = append(files, os.NewFile(uintptr(fd), ln.addr))
+		// The fds of cmd.ExtraFiles start from 3 in the new process.
+		key := ln.network + "://" + ln.addr
+		if ln.activated {
+			key = ln.activatedAs
+		}
+		fds[key] = append(fds[key], 2+len(files))
+	}
+	desc, err := json.Marshal(fds)
+	if err != nil {
+		return 0, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	files = append(files, w)
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envInheritedListeners+"=") && !strings.HasPrefix(kv, envRestartReadyFd+"=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		envInheritedListeners+"="+string(desc),
+		fmt.Sprintf("%s=%d", envRestartReadyFd, 2+len(files)))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	if err = cmd.Start(); err != nil {
+		return 0, err
+	}
+	go func() {
+		_ = cmd.Wait()
+	}()
+	// Close the write end in this process so that reading fails once the new process exits.
+	_ = w.Close()
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+		if err != nil {
+			_ = cmd.Process.Kill()
+			return 0, errors.ErrRestartFailed
+		}
+	case <-ctx.Done():
+		_ = cmd.Process.Kill()
+		return 0, ctx.Err()
+	}
+
+	for _, ln := range lns {
+		ln.detached = true
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(protoAddrs))
+	for i, protoAddr := range protoAddrs {
+		wg.Add(1)
+		go func(i int, protoAddr string) {
+			errs[i] = Stop(ctx, protoAddr)
+			wg.Done()
+		}(i, protoAddr)
+	}
+	wg.Wait()
+	for _, err = range errs {
+		if err != nil {
+			break
+		}
+	}
+	return cmd.Process.Pid, err
+}
@@ -3,7 +3,9 @@
 package shpnetpoll
 
 import (
+	"net"
 	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -11,21 +13,35 @@ import (
 	"shpnetpoll/errors"
 	"shpnetpoll/internal/logging"
 	"shpnetpoll/internal/netpoll"
+	"shpnetpoll/pool/goroutine"
 )
 
 type server struct {
-	ln           *listener          // the listener for accepting new connections
-	lb           loadBalancer       // event-loops for handling events
-	wg           sync.WaitGroup     // event-loop close WaitGroup
-	opts         *Options           // options with server
-	once         sync.Once          // make sure only signalShutdown once
-	cond         *sync.Cond         // shutdown signaler
-	codec        ICodec             // codec for TCP stream
-	logger       logging.Logger     // customized logger for logging info
-	ticktock     chan time.Duration // ticker channel
-	mainLoop     *eventloop         // main event-loop for accepting connections
-	inShutdown   int32              // whether the server is in shutdown
-	eventHandler EventHandler       // user eventHandler
+	bufferedBytes    int64              // bytes in the buffers of all connections, kept first for 64-bit alignment
+	offloadsRejected uint64             // number of frames failed to be offloaded, kept next to bufferedBytes for 64-bit alignment
+	workersOnce      sync.Once          // make sure only create the worker pool once
+	workers          *goroutine.Pool    // worker pool of offloaded frames, nil until it's used
+	workersErr       error              // error of creating the worker pool
+	ln               *listener          // the first listener for accepting new connections
+	lns              []*listener        // all listeners for accepting new connections
+	protoAddrs       []string           // addresses of all listeners the server is served on
+	lb               loadBalancer       // event-loops for handling events
+	wg               sync.WaitGroup     // event-loop close WaitGroup
+	opts             *Options           // options with server
+	once             sync.Once          // make sure only signalShutdown once
+	drainOnce        sync.Once          // make sure only drain once
+	scaleMu          sync.Mutex         // serializes scaling event-loops with draining and shutting down
+	scaleStopped     bool               // whether event-loops can no longer be scaled, guarded by scaleMu
+	scaleStarted     bool               // whether event-loops have been started and can be scaled, guarded by scaleMu
+	statsMu          sync.Mutex         // guards retiredStats
+	retiredStats     EventLoopStats     // sum of the counters of retired event-loops
+	cond             *sync.Cond         // shutdown signaler
+	codec            ICodec             // codec for TCP stream
+	logger           logging.Logger     // customized logger for logging info
+	ticktock         chan time.Duration // ticker channel
+	mainLoop         *eventloop         // main event-loop for accepting connections
+	inShutdown       int32              // whether the server is in shutdown
+	eventHandler     EventHandler       // user eventHandler
 }
 
 var serverFarm sync.Map
@@ -50,6 +66,93 @@ func (svr *server) signalShutdown() {
 	})
 }
 
+// countConns counts the number of currently active connections of all event-loops.
+func (svr *server) countConns() (count int) {
+	svr.lb.iterate(func(i int, el *eventloop) bool {
+		count += int(atomic.LoadInt32(&el.connCount))
+		return true
+	})
+	return
+}
+
+// drain stops accepting new connections and asks every event-loop to drain its connections.
+func (svr *server) drain() {
+	svr.drainOnce.Do(func() {
+		svr.scaleMu.Lock()
+		svr.scaleStopped = true
+		svr.scaleMu.Unlock()
+
+		var loops []*eventloop
+		if svr.mainLoop != nil {
+			loops = append(loops, svr.mainLoop)
+		}
+		svr.lb.iterate(func(i int, el *eventloop) bool {
+			loops = append(loops, el)
+			return true
+		})
+
+		// Listeners can't be closed until all event-loops have stopped watching them,
+		// otherwise their fds might be reused by new connections in the meantime.
+		pending := int32(len(loops))
+		for _, el := range loops {
+			el := el
+			sniffErrorAndLog(el.poller.UrgentTrigger(func() error {
+				err := el.loopDrain()
+				if atomic.AddInt32(&pending, -1) == 0 {
+					svr.closeListeners()
+				}
+				return err
+			}))
+		}
+	})
+}
+
+// closeListeners closes the listeners of all event-loops.
+func (svr *server) closeListeners() {
+	for _, ln := range svr.listeners() {
+		ln.close()
+	}
+}
+
+// listeners returns all the listeners of server, including the ones bound by event-loops in ReusePort mode.
+func (svr *server) listeners() []*listener {
+	lns := append([]*listener(nil), svr.lns...)
+	seen := make(map[*listener]bool, len(lns))
+	for _, ln := range lns {
+		seen[ln] = true
+	}
+	svr.lb.iterate(func(i int, el *eventloop) bool {
+		for _, ln := range el.listeners {
+			if !seen[ln] {
+				seen[ln] = true
+				lns = append(lns, ln)
+			}
+		}
+		return true
+	})
+	return lns
+}
+
+// sharesListener reports whether the listener is shared by event-loops rather than bound for one of them.
+func (svr *server) sharesListener(ln *listener) bool {
+	for _, l := range svr.lns {
+		if l == ln {
+			return true
+		}
+	}
+	return false
+}
+
+// hasUDP reports whether the server is served on any UDP address.
+func (svr *server) hasUDP() bool {
+	for _, ln := range svr.lns {
+		if ln.network == "udp" {
+			return true
+		}
+	}
+	return false
+}
+
 func (svr *server) startEventLoops() {
 	svr.lb.iterate(func(i int, el *eventloop) bool {
 		svr.wg.Add(1)
@@ -79,36 +182,64 @@ func (svr *server) startSubReactors() {
 	})
 }
 
+// openEventLoop creates an event-loop and registers it to the load-balancer.
+func (svr *server) openEventLoop() (*eventloop, error) {
+	p, kind, err := openPoller(svr.opts)
+	if err != nil {
+		return nil, err
+	}
+	if svr.lb.len() == 0 {
+		// No event-loop is running yet, settle options with the mechanism in use.
+		svr.opts.Poller = kind
+		if svr.opts.EdgeTriggered && kind != EpollPoller {
+			logging.DefaultLogger.Warnf("edge-triggered mode is only supported by epoll, turning it off")
+			svr.opts.EdgeTriggered = false
+		}
+	} else if svr.opts.EdgeTriggered && kind != EpollPoller {
+		// Options can't be changed any more since the running event-loops read them.
+		_ = p.Close()
+		return nil, errors.ErrUnsupportedOp
+	}
+	el := newEventLoop(svr, p)
+	svr.lb.register(el)
+	return el, nil
+}
+
+// watchListeners makes the event-loop watch all listeners of server, the listeners are bound again for it
+// if rebind is true and they can be in ReusePort mode.
+func (svr *server) watchListeners(el *eventloop, rebind bool) (err error) {
+	for _, ln := range svr.lns {
+		l := ln
+		// Unix Domain Sockets can't be bound to the same path more than once, neither can the sockets
+		// passed in by a supervisor be bound again, so all event-loops share one listener.
+		if exclusive := svr.opts.ReusePort && ln.network != "unix" && !ln.activated; exclusive {
+			if rebind {
+				if l, err = initListener(ln.network, ln.addr, svr.opts); err != nil {
+					return
+				}
+			}
+			el.steerIncomingCPU(l)
+		}
+		_ = el.addListener(l)
+	}
+	return
+}
+
 func (svr *server) activateEventLoops(numEventLoop int) (err error) {
 	// Create loops locally and bind the listeners.
 	for i := 0; i < numEventLoop; i++ {
-		l := svr.ln
-		if i > 0 && svr.opts.ReusePort {
-			if l, err = initListener(svr.ln.network, svr.ln.addr, svr.ln.reusePort); err != nil {
-				return
-			}
+		var el *eventloop
+		if el, err = svr.openEventLoop(); err != nil {
+			return
 		}
-
-		var p *netpoll.Poller
-		if p, err = netpoll.OpenPoller(); err == nil {
-			el := new(eventloop)
-			el.ln = l
-			el.svr = svr
-			el.poller = p
-			el.packet = make([]byte, svr.opts.ReadBufferCap)
-			el.connections = make(map[int]*conn)
-			el.eventHandler = svr.eventHandler
-			el.calibrateCallback = svr.lb.calibrate
-			_ = el.poller.AddRead(el.ln.fd)
-			svr.lb.register(el)
-
-			// Start the ticker.
-			if el.idx == 0 && svr.opts.Ticker {
-				go el.loopTicker()
-			}
-		} else {
+		if err = svr.watchListeners(el, i > 0); err != nil {
 			return
 		}
+
+		// Start the ticker.
+		if el.idx == 0 && svr.opts.Ticker {
+			go el.loopTicker()
+		}
 	}
 
 	// Start event-loops in background.
@@ -120,19 +251,8 @@ func (svr *server) activateEventLoops(numEventLoop int) (err error) {
 func (svr *server) activateReactors(numEventLoop int) error {
 	// 创建numEventLoop个eventLoop
 	for i := 0; i < numEventLoop; i++ {
-		// 为每一个eventLoop设置一个poller
-		if p, err := netpoll.OpenPoller(); err == nil {
-			el := new(eventloop)
-			el.ln = svr.ln
-			el.svr = svr
-			el.poller = p
-			el.packet = make([]byte, svr.opts.ReadBufferCap)
-			el.connections = make(map[int]*conn)
-			el.eventHandler = svr.eventHandler
-			el.calibrateCallback = svr.lb.calibrate
-			// 将eventLoop注册到 负载均衡上
-			svr.lb.register(el)
-
+		// 为每一个eventLoop设置一个poller，并将eventLoop注册到 负载均衡上
+		if el, err := svr.openEventLoop(); err == nil {
 			// Start the ticker.
 			if el.idx == 0 && svr.opts.Ticker {
 				go el.loopTicker()
@@ -147,15 +267,18 @@ func (svr *server) activateReactors(numEventLoop int) error {
 	svr.startSubReactors()
 
 	// 创建eventLoop
-	if p, err := netpoll.OpenPoller(); err == nil {
+	if p, _, err := openPoller(svr.opts); err == nil {
 		el := new(eventloop)
-		el.ln = svr.ln
+		el.listeners = make(map[int]*listener)
 		el.idx = -1
 		el.svr = svr
 		// 在这里将epoll fd 赋值给主Reactor
 		el.poller = p
+		el.completer, _ = p.(netpoll.Completer)
 		// 在这里将listener 监听的fd添加到epoll的读事件
-		_ = el.poller.AddRead(el.ln.fd)
+		for _, ln := range svr.lns {
+			_ = el.addListener(ln)
+		}
 		svr.mainLoop = el
 
 		// Start main reactor in background.
@@ -172,13 +295,17 @@ func (svr *server) activateReactors(numEventLoop int) error {
 	return nil
 }
 
-func (svr *server) start(numEventLoop int) error {
-	if svr.opts.ReusePort || svr.ln.network == "udp" {
-		return svr.activateEventLoops(numEventLoop)
+func (svr *server) start(numEventLoop int) (err error) {
+	if svr.opts.ReusePort || svr.hasUDP() {
+		err = svr.activateEventLoops(numEventLoop)
+	} else {
+		// 启动reactor模式
+		err = svr.activateReactors(numEventLoop)
 	}
-
-	// 启动reactor模式
-	return svr.activateReactors(numEventLoop)
+	if err == nil && svr.opts.SlowCallbackThreshold > 0 {
+		go svr.watchSlowCallbacks()
+	}
+	return
 }
 
 func (svr *server) stop(s Server) {
@@ -187,17 +314,23 @@ func (svr *server) stop(s Server) {
 
 	svr.eventHandler.OnShutdown(s)
 
+	svr.scaleMu.Lock()
+	svr.scaleStopped = true
+	svr.scaleMu.Unlock()
+
 	// Notify all loops to close by closing all listeners
 	svr.lb.iterate(func(i int, el *eventloop) bool {
-		sniffErrorAndLog(el.poller.Trigger(func() error {
+		sniffErrorAndLog(el.poller.UrgentTrigger(func() error {
 			return errors.ErrServerShutdown
 		}))
 		return true
 	})
 
 	if svr.mainLoop != nil {
-		svr.ln.close()
-		sniffErrorAndLog(svr.mainLoop.poller.Trigger(func() error {
+		for _, ln := range svr.lns {
+			ln.close()
+		}
+		sniffErrorAndLog(svr.mainLoop.poller.UrgentTrigger(func() error {
 			return errors.ErrServerShutdown
 		}))
 	}
@@ -211,6 +344,8 @@ func (svr *server) stop(s Server) {
 		sniffErrorAndLog(svr.mainLoop.poller.Close())
 	}
 
+	svr.releaseWorkerPool()
+
 	// Stop the ticker.
 	if svr.opts.Ticker {
 		close(svr.ticktock)
@@ -219,8 +354,135 @@ func (svr *server) stop(s Server) {
 	atomic.StoreInt32(&svr.inShutdown, 1)
 }
 
-func serve(eventHandler EventHandler, listener *listener, options *Options, protoAddr string) error {
-	// Figure out the proper number of event-loops/goroutines to run.
+// scale adds or retires event-loops to make the number of them n, see Server.ScaleEventLoops.
+func (svr *server) scale(n int) error {
+	if n <= 0 {
+		return errors.ErrInvalidNumEventLoop
+	}
+	if svr.opts.LockOSThread && n > 10000 {
+		return errors.ErrTooManyEventLoopThreads
+	}
+
+	svr.scaleMu.Lock()
+	defer svr.scaleMu.Unlock()
+	if svr.scaleStopped || svr.isInShutdown() {
+		return errors.ErrServerInShutdown
+	}
+	if !svr.scaleStarted {
+		return errors.ErrServerNotStarted
+	}
+
+	for size := svr.lb.len(); size < n; size++ {
+		el, err := svr.openEventLoop()
+		if err != nil {
+			return err
+		}
+		if svr.mainLoop == nil {
+			if err = svr.watchListeners(el, true); err != nil {
+				svr.lb.unregister(el)
+				for _, ln := range el.listeners {
+					if !svr.sharesListener(ln) {
+						ln.close()
+					}
+				}
+				_ = el.poller.Close()
+				return err
+			}
+		}
+		svr.wg.Add(1)
+		go func() {
+			if svr.mainLoop == nil {
+				el.loopRun(svr.opts.LockOSThread)
+			} else {
+				svr.activateSubReactor(el, svr.opts.LockOSThread)
+			}
+			svr.wg.Done()
+		}()
+	}
+
+	// Retire the event-loops with the highest indexes, so that the indexes of the rest are kept continuous.
+	for size := svr.lb.len(); size > n; size-- {
+		el := svr.eventLoopAt(size - 1)
+		if el == nil {
+			break
+		}
+		svr.lb.unregister(el)
+		done := make(chan struct{})
+		if err := el.poller.UrgentTrigger(func() error {
+			defer close(done)
+			return el.loopRetire()
+		}); err != nil {
+			return err
+		}
+		// The event-loop might have exited on its own before running the task, which would never be done then.
+		select {
+		case <-done:
+		case <-el.exited:
+		}
+	}
+	return nil
+}
+
+// eventLoopAt returns the event-loop with the given index, nil if there is no such one.
+func (svr *server) eventLoopAt(idx int) (el *eventloop) {
+	svr.lb.iterate(func(i int, v *eventloop) bool {
+		if v.idx == idx {
+			el = v
+		}
+		return el == nil
+	})
+	return
+}
+
+// rebalance evens out the connections among event-loops by migrating the surplus ones of the busiest event-loops
+// to the idlest ones, it returns without waiting for the migrations.
+func (svr *server) rebalance() {
+	type load struct {
+		el    *eventloop
+		conns int
+	}
+	var (
+		loads []load
+		total int
+	)
+	svr.lb.iterate(func(i int, el *eventloop) bool {
+		n := int(el.ConnCount())
+		loads = append(loads, load{el, n})
+		total += n
+		return true
+	})
+	if len(loads) < 2 {
+		return
+	}
+
+	// The busiest event-loops keep one connection more than the others if they can't be evened out exactly.
+	sort.Slice(loads, func(i, j int) bool { return loads[i].conns > loads[j].conns })
+	quota, rem := total/len(loads), total%len(loads)
+	var vacancies []*eventloop
+	for i, l := range loads {
+		if i < rem {
+			loads[i].conns -= quota + 1
+		} else {
+			loads[i].conns -= quota
+		}
+		for n := loads[i].conns; n < 0; n++ {
+			vacancies = append(vacancies, l.el)
+		}
+	}
+	for _, l := range loads {
+		if l.conns <= 0 {
+			continue
+		}
+		el, targets := l.el, vacancies[:l.conns]
+		vacancies = vacancies[l.conns:]
+		sniffErrorAndLog(el.poller.UrgentTrigger(func() error {
+			return el.loopShed(targets)
+		}))
+	}
+}
+
+// numEventLoops figures out the proper number of event-loops/goroutines to run.
+func numEventLoops(options *Options) int {
 	numEventLoop := 1
 	if options.Multicore {
 		numEventLoop = runtime.NumCPU()
@@ -228,21 +490,58 @@ func serve(eventHandler EventHandler, listener *listener, options *Options, prot
 	if options.NumEventLoop > 0 {
 		numEventLoop = options.NumEventLoop
 	}
+	return numEventLoop
+}
+
+// openPoller instantiates the poller of an event-loop with the mechanism chosen by options, it falls back to epoll
+// and then poll(2) if the chosen one is not available, and returns the mechanism in use. options is only read since
+// it's shared with the running event-loops.
+func openPoller(options *Options) (p netpoll.Poller, kind PollerType, err error) {
+	switch kind = options.Poller; kind {
+	case IOUringPoller:
+		if p, err = netpoll.OpenIOUringPoller(options.AsyncTaskQueueCapacity, options.ReadBufferCap); err == nil {
+			break
+		}
+		logging.DefaultLogger.Warnf("io_uring is not available, falling back to epoll: %v", err)
+		kind = EpollPoller
+		fallthrough
+	case EpollPoller:
+		if p, err = netpoll.OpenPoller(options.AsyncTaskQueueCapacity); err == nil {
+			break
+		}
+		logging.DefaultLogger.Warnf("epoll is not available, falling back to poll: %v", err)
+		kind = PollPoller
+		fallthrough
+	default:
+		if p, err = netpoll.OpenPollPoller(options.AsyncTaskQueueCapacity); err != nil {
+			return nil, kind, err
+		}
+	}
+	return p, kind, nil
+}
 
+// newServer instantiates the internal server which drives the event-loops, it is shared by Serve and Client.
+func newServer(eventHandler EventHandler, options *Options) *server {
 	svr := new(server)
 	svr.opts = options
 	svr.eventHandler = eventHandler
-	// 设置监听器
-	svr.ln = listener
 
 	// 负载均衡
-	switch options.LB {
-	case RoundRobin:
+	switch {
+	case options.CustomLB != nil:
+		svr.lb = newCustomLoadBalancer(options.CustomLB)
+	case options.LB == RoundRobin:
 		svr.lb = new(roundRobinLoadBalancer)
-	case LeastConnections:
+	case options.LB == LeastConnections:
 		svr.lb = new(leastConnectionsLoadBalancer)
-	case SourceAddrHash:
+	case options.LB == SourceAddrHash:
 		svr.lb = new(sourceAddrHashLoadBalancer)
+	case options.LB == ConsistentHash:
+		svr.lb = new(consistentHashLoadBalancer)
+	case options.LB == WeightedRoundRobin:
+		svr.lb = newWeightedRoundRobinLoadBalancer(options.LBWeights)
+	case options.LB == PowerOfTwoChoices:
+		svr.lb = new(powerOfTwoChoicesLoadBalancer)
 	}
 
 	svr.cond = sync.NewCond(&sync.Mutex{})
@@ -254,11 +553,27 @@ func serve(eventHandler EventHandler, listener *listener, options *Options, prot
 		}
 		return options.Codec
 	}()
+	return svr
+}
 
+func serve(eventHandler EventHandler, listeners []*listener, options *Options, protoAddrs []string) error {
+	numEventLoop := numEventLoops(options)
+
+	svr := newServer(eventHandler, options)
+	// 设置监听器
+	svr.ln = listeners[0]
+	svr.lns = listeners
+	svr.protoAddrs = protoAddrs
+
+	addrs := make([]net.Addr, len(listeners))
+	for i, ln := range listeners {
+		addrs[i] = ln.lnaddr
+	}
 	server := Server{
 		svr:          svr,
 		Multicore:    options.Multicore,
-		Addr:         listener.lnaddr,
+		Addr:         svr.ln.lnaddr,
+		Addrs:        addrs,
 		NumEventLoop: numEventLoop,
 		ReusePort:    options.ReusePort,
 		TCPKeepAlive: options.TCPKeepAlive,
@@ -269,14 +584,24 @@ func serve(eventHandler EventHandler, listener *listener, options *Options, prot
 		return nil
 	}
 	// 开启服务
-	if err := svr.start(numEventLoop); err != nil {
+	// Event-loops can't be scaled until they are all started, nor can the main reactor be set up in the meantime.
+	svr.scaleMu.Lock()
+	err := svr.start(numEventLoop)
+	svr.scaleStarted = err == nil
+	svr.scaleMu.Unlock()
+	if err != nil {
 		svr.closeEventLoops()
+		svr.closeListeners()
 		svr.logger.Errorf("gnet server is stopping with error: %v", err)
 		return err
 	}
 	defer svr.stop(server)
 
-	serverFarm.Store(protoAddr, svr)
+	for _, protoAddr := range protoAddrs {
+		serverFarm.Store(protoAddr, svr)
+	}
+	svr.adoptSpareListeners()
+	notifyRestartReady()
 
 	return nil
 }
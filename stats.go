@@ -0,0 +1,347 @@
+// +build linux freebsd dragonfly darwin
+
+package shpnetpoll
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"shpnetpoll/errors"
+)
+
+// EventLoopStats are the metrics of an event-loop, the counters are accumulated since the event-loop was started.
+type EventLoopStats struct {
+	// Index is the index of event-loop, -1 for the sum of all event-loops in Stats.Total.
+	Index int
+
+	// Connections is the number of active connections.
+	Connections int
+
+	// Accepted is the number of connections opened, including the ones dialed by Client.
+	Accepted uint64
+
+	// Closed is the number of connections closed.
+	Closed uint64
+
+	// BytesRead is the number of bytes read from connections and UDP sockets.
+	BytesRead uint64
+
+	// BytesWritten is the number of bytes written to connections and UDP sockets, including the ones sent by sendfile(2).
+	BytesWritten uint64
+
+	// Reacts is the number of React invocations.
+	Reacts uint64
+
+	// CodecErrors is the number of frames which failed to be encoded or decoded by the codec,
+	// the incomplete frames waiting for more data are not counted.
+	CodecErrors uint64
+
+	// PartialWrites is the number of writes which hit EAGAIN or were cut short by the socket,
+	// leaving the rest of data to the outbound buffers.
+	PartialWrites uint64
+
+	// InboundBytes is the number of bytes buffered for the incomplete frames in the inbound buffers.
+	InboundBytes int64
+
+	// OutboundBytes is the number of bytes waiting in the outbound buffers.
+	OutboundBytes int64
+
+	// OutboundHighWater is the peak of OutboundBytes.
+	OutboundHighWater int64
+
+	// AsyncTasks is the number of tasks triggered by AsyncWrite, Wake, Close, etc.
+	AsyncTasks uint64
+
+	// PendingTasks is the number of tasks waiting to be run.
+	PendingTasks int
+
+	// Offloads is the number of frames offloaded to the worker pool by Conn.Offload.
+	Offloads uint64
+
+	// InflightOffloads is the number of offloaded frames whose replies are not done yet.
+	InflightOffloads int64
+
+	// Latency is the smoothed duration spent on handling the events of recent iterations.
+	Latency time.Duration
+
+	// EventDelay is the histogram of delays between the poller returning network-events and handling them,
+	// it's only recorded with Options.LatencyHistograms, as are CallbackDuration and TaskDuration.
+	EventDelay Histogram
+
+	// CallbackDuration is the histogram of durations of handling network-events.
+	CallbackDuration Histogram
+
+	// TaskDuration is the histogram of durations of running asynchronous tasks.
+	TaskDuration Histogram
+}
+
+// Stats is a snapshot of the metrics of server.
+type Stats struct {
+	// EventLoops are the metrics of the running event-loops in the order of their indexes.
+	EventLoops []EventLoopStats
+
+	// Total is the sum of all event-loops, including the ones retired by Server.ScaleEventLoops,
+	// OutboundHighWater and Latency are the maximum ones of the running event-loops.
+	Total EventLoopStats
+
+	// WorkerPool is the metrics of the worker pool of offloaded frames.
+	WorkerPool WorkerPoolStats
+}
+
+// WorkerPoolStats are the metrics of the worker pool of offloaded frames, which is saturated when Running reaches
+// Capacity, the frames offloaded then are rejected.
+type WorkerPoolStats struct {
+	// Capacity is the maximum number of workers, 0 if the worker pool has not been used.
+	Capacity int
+
+	// Running is the number of workers running offloaded frames.
+	Running int
+
+	// Rejected is the number of frames failed to be offloaded.
+	Rejected uint64
+}
+
+// loopStats are the counters of event-loop, which are updated by the event-loop and read from any goroutine.
+type loopStats struct {
+	accepted          uint64
+	closed            uint64
+	bytesRead         uint64
+	bytesWritten      uint64
+	reacts            uint64
+	codecErrors       uint64
+	partialWrites     uint64
+	offloads          uint64
+	outboundHighWater int64
+	inflightOffloads  int64
+}
+
+// observeOutbound raises the high-water mark of outbound buffers to n.
+func (s *loopStats) observeOutbound(n int64) {
+	for {
+		old := atomic.LoadInt64(&s.outboundHighWater)
+		if n <= old || atomic.CompareAndSwapInt64(&s.outboundHighWater, old, n) {
+			return
+		}
+	}
+}
+
+// isIncompleteFrame reports whether the error of decoding means that the frame is waiting for more data.
+func isIncompleteFrame(err error) bool {
+	return err == errors.ErrUnexpectedEOF || err == errors.ErrDelimiterNotFound || err == errors.ErrCRLFNotFound
+}
+
+func (el *eventloop) stats() EventLoopStats {
+	s := EventLoopStats{
+		Index:             el.idx,
+		Connections:       int(el.ConnCount()),
+		Accepted:          atomic.LoadUint64(&el.counters.accepted),
+		Closed:            atomic.LoadUint64(&el.counters.closed),
+		BytesRead:         atomic.LoadUint64(&el.counters.bytesRead),
+		BytesWritten:      atomic.LoadUint64(&el.counters.bytesWritten),
+		Reacts:            atomic.LoadUint64(&el.counters.reacts),
+		CodecErrors:       atomic.LoadUint64(&el.counters.codecErrors),
+		PartialWrites:     atomic.LoadUint64(&el.counters.partialWrites),
+		InboundBytes:      el.InboundBytes(),
+		OutboundBytes:     el.OutboundBytes(),
+		OutboundHighWater: atomic.LoadInt64(&el.counters.outboundHighWater),
+		AsyncTasks:        el.poller.TriggeredTasks(),
+		PendingTasks:      el.PendingTasks(),
+		Offloads:          atomic.LoadUint64(&el.counters.offloads),
+		InflightOffloads:  atomic.LoadInt64(&el.counters.inflightOffloads),
+		Latency:           el.Latency(),
+	}
+	if o := el.observer; o != nil && o.histograms {
+		s.EventDelay = o.eventDelay.snapshot()
+		s.CallbackDuration = o.callback.snapshot()
+		s.TaskDuration = o.task.snapshot()
+	}
+	return s
+}
+
+// add accumulates the metrics of an event-loop into s.
+func (s *EventLoopStats) add(o EventLoopStats) {
+	s.Connections += o.Connections
+	s.Accepted += o.Accepted
+	s.Closed += o.Closed
+	s.BytesRead += o.BytesRead
+	s.BytesWritten += o.BytesWritten
+	s.Reacts += o.Reacts
+	s.CodecErrors += o.CodecErrors
+	s.PartialWrites += o.PartialWrites
+	s.InboundBytes += o.InboundBytes
+	s.OutboundBytes += o.OutboundBytes
+	s.AsyncTasks += o.AsyncTasks
+	s.PendingTasks += o.PendingTasks
+	s.Offloads += o.Offloads
+	s.InflightOffloads += o.InflightOffloads
+	if o.OutboundHighWater > s.OutboundHighWater {
+		s.OutboundHighWater = o.OutboundHighWater
+	}
+	if o.Latency > s.Latency {
+		s.Latency = o.Latency
+	}
+	s.EventDelay.add(o.EventDelay)
+	s.CallbackDuration.add(o.CallbackDuration)
+	s.TaskDuration.add(o.TaskDuration)
+}
+
+// retireStats keeps the counters of the retired event-loop in the total of server once it exits.
+func (svr *server) retireStats(el *eventloop) {
+	s := el.stats()
+	s.Connections, s.InboundBytes, s.OutboundBytes, s.PendingTasks, s.InflightOffloads = 0, 0, 0, 0, 0
+	s.OutboundHighWater, s.Latency = 0, 0
+	svr.statsMu.Lock()
+	svr.retiredStats.add(s)
+	svr.statsMu.Unlock()
+}
+
+func (svr *server) stats() (s Stats) {
+	svr.lb.iterate(func(i int, el *eventloop) bool {
+		s.EventLoops = append(s.EventLoops, el.stats())
+		return true
+	})
+	// Load-balancers may keep event-loops in any order.
+	sort.Slice(s.EventLoops, func(i, j int) bool { return s.EventLoops[i].Index < s.EventLoops[j].Index })
+
+	svr.statsMu.Lock()
+	s.Total = svr.retiredStats
+	svr.statsMu.Unlock()
+	s.Total.Index = -1
+	for _, ls := range s.EventLoops {
+		s.Total.add(ls)
+	}
+
+	svr.workersOnce.Do(func() {})
+	if svr.workers != nil {
+		s.WorkerPool.Capacity = svr.workers.Cap()
+		s.WorkerPool.Running = svr.workers.Running()
+	}
+	s.WorkerPool.Rejected = atomic.LoadUint64(&svr.offloadsRejected)
+	return
+}
+
+// metric describes a metric in the Prometheus text-based exposition format.
+type metric struct {
+	name, typ, help string
+	value           func(s *EventLoopStats) float64
+}
+
+var metrics = []metric{
+	{"gnet_connections", "gauge", "Number of active connections.",
+		func(s *EventLoopStats) float64 { return float64(s.Connections) }},
+	{"gnet_connections_accepted_total", "counter", "Number of connections opened.",
+		func(s *EventLoopStats) float64 { return float64(s.Accepted) }},
+	{"gnet_connections_closed_total", "counter", "Number of connections closed.",
+		func(s *EventLoopStats) float64 { return float64(s.Closed) }},
+	{"gnet_read_bytes_total", "counter", "Number of bytes read.",
+		func(s *EventLoopStats) float64 { return float64(s.BytesRead) }},
+	{"gnet_written_bytes_total", "counter", "Number of bytes written.",
+		func(s *EventLoopStats) float64 { return float64(s.BytesWritten) }},
+	{"gnet_reacts_total", "counter", "Number of React invocations.",
+		func(s *EventLoopStats) float64 { return float64(s.Reacts) }},
+	{"gnet_codec_errors_total", "counter", "Number of frames failed to be encoded or decoded.",
+		func(s *EventLoopStats) float64 { return float64(s.CodecErrors) }},
+	{"gnet_partial_writes_total", "counter", "Number of writes which hit EAGAIN or were cut short.",
+		func(s *EventLoopStats) float64 { return float64(s.PartialWrites) }},
+	{"gnet_inbound_bytes", "gauge", "Number of bytes buffered for incomplete frames in inbound buffers.",
+		func(s *EventLoopStats) float64 { return float64(s.InboundBytes) }},
+	{"gnet_outbound_bytes", "gauge", "Number of bytes waiting in outbound buffers.",
+		func(s *EventLoopStats) float64 { return float64(s.OutboundBytes) }},
+	{"gnet_outbound_high_water_bytes", "gauge", "Peak number of bytes waiting in outbound buffers.",
+		func(s *EventLoopStats) float64 { return float64(s.OutboundHighWater) }},
+	{"gnet_async_tasks_total", "counter", "Number of asynchronous tasks triggered.",
+		func(s *EventLoopStats) float64 { return float64(s.AsyncTasks) }},
+	{"gnet_pending_async_tasks", "gauge", "Number of asynchronous tasks waiting to be run.",
+		func(s *EventLoopStats) float64 { return float64(s.PendingTasks) }},
+	{"gnet_offloads_total", "counter", "Number of frames offloaded to the worker pool.",
+		func(s *EventLoopStats) float64 { return float64(s.Offloads) }},
+	{"gnet_inflight_offloads", "gauge", "Number of offloaded frames waiting for their replies.",
+		func(s *EventLoopStats) float64 { return float64(s.InflightOffloads) }},
+	{"gnet_loop_latency_seconds", "gauge", "Smoothed duration spent on handling the events of an iteration.",
+		func(s *EventLoopStats) float64 { return s.Latency.Seconds() }},
+}
+
+// histogramMetric describes a histogram in the Prometheus text-based exposition format.
+type histogramMetric struct {
+	name, help string
+	value      func(s *EventLoopStats) *Histogram
+}
+
+var histogramMetrics = []histogramMetric{
+	{"gnet_event_delay_seconds", "Delay between the poller returning network-events and handling them.",
+		func(s *EventLoopStats) *Histogram { return &s.EventDelay }},
+	{"gnet_callback_duration_seconds", "Duration of handling network-events.",
+		func(s *EventLoopStats) *Histogram { return &s.CallbackDuration }},
+	{"gnet_task_duration_seconds", "Duration of running asynchronous tasks.",
+		func(s *EventLoopStats) *Histogram { return &s.TaskDuration }},
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+// WritePrometheus writes the metrics in the Prometheus text-based exposition format. Every metric comes with a series
+// labeled with the index of each running event-loop, and a series without the label for Stats.Total, which keeps
+// counting across Server.ScaleEventLoops while the event-loop of an index may be retired and started from scratch.
+func (s Stats) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	_, _ = fmt.Fprintf(bw, "# HELP gnet_event_loops Number of running event-loops.\n"+
+		"# TYPE gnet_event_loops gauge\ngnet_event_loops %d\n", len(s.EventLoops))
+	_, _ = fmt.Fprintf(bw, "# HELP gnet_worker_pool_capacity Maximum number of workers of offloaded frames.\n"+
+		"# TYPE gnet_worker_pool_capacity gauge\ngnet_worker_pool_capacity %d\n"+
+		"# HELP gnet_worker_pool_running Number of workers running offloaded frames.\n"+
+		"# TYPE gnet_worker_pool_running gauge\ngnet_worker_pool_running %d\n"+
+		"# HELP gnet_worker_pool_rejected_total Number of frames failed to be offloaded.\n"+
+		"# TYPE gnet_worker_pool_rejected_total counter\ngnet_worker_pool_rejected_total %d\n",
+		s.WorkerPool.Capacity, s.WorkerPool.Running, s.WorkerPool.Rejected)
+	for _, m := range metrics {
+		_, _ = fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		_, _ = fmt.Fprintf(bw, "%s %s\n", m.name, strconv.FormatFloat(m.value(&s.Total), 'f', -1, 64))
+		for i := range s.EventLoops {
+			_, _ = fmt.Fprintf(bw, "%s{loop=\"%d\"} %s\n", m.name, s.EventLoops[i].Index,
+				strconv.FormatFloat(m.value(&s.EventLoops[i]), 'f', -1, 64))
+		}
+	}
+	for _, m := range histogramMetrics {
+		if m.value(&s.Total).Bounds == nil {
+			continue
+		}
+		_, _ = fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s histogram\n", m.name, m.help, m.name)
+		writeHistogram(bw, m.name, "", m.value(&s.Total))
+		for i := range s.EventLoops {
+			writeHistogram(bw, m.name, fmt.Sprintf("loop=\"%d\"", s.EventLoops[i].Index), m.value(&s.EventLoops[i]))
+		}
+	}
+	return bw.Flush()
+}
+
+// writeHistogram writes the series of a histogram with the given labels, which may be empty.
+func writeHistogram(w io.Writer, name, labels string, h *Histogram) {
+	sep := labels
+	if sep != "" {
+		sep += ","
+		labels = "{" + labels + "}"
+	}
+	var cumulative uint64
+	for j, bound := range h.Bounds {
+		cumulative += h.Counts[j]
+		_, _ = fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, sep, formatSeconds(bound), cumulative)
+	}
+	_, _ = fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, sep, h.Count)
+	_, _ = fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatSeconds(h.Sum))
+	_, _ = fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.Count)
+}
+
+// metricsHandler serves the metrics of server in the Prometheus text-based exposition format.
+func (svr *server) metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = svr.stats().WritePrometheus(w)
+	})
+}
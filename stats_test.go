@@ -0,0 +1,65 @@
+// +build linux freebsd dragonfly darwin
+
+package shpnetpoll
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func TestWritePrometheus(t *testing.T) {
+	histogram := func(counts ...uint64) Histogram {
+		h := Histogram{Bounds: []time.Duration{time.Microsecond, time.Millisecond}, Counts: counts}
+		for i, n := range counts {
+			h.Count += n
+			h.Sum += time.Duration(n) * time.Duration(i+1) * 500 * time.Microsecond
+		}
+		return h
+	}
+	loop := func(idx, conns int, n uint64) EventLoopStats {
+		return EventLoopStats{
+			Index: idx, Connections: conns, Accepted: n, Closed: n - uint64(conns), BytesRead: n * 100,
+			BytesWritten: n * 200, Reacts: n * 10, CodecErrors: 1, PartialWrites: 2, InboundBytes: 3,
+			OutboundBytes: 4, OutboundHighWater: 5, AsyncTasks: n * 3, PendingTasks: 6, Offloads: 7,
+			InflightOffloads: 8, Latency: time.Duration(idx+1) * 25 * time.Microsecond,
+			EventDelay: histogram(n, 1, 0), CallbackDuration: histogram(n, 2, 1), TaskDuration: histogram(0, 0, n),
+		}
+	}
+
+	// Event-loop 1 has been retired, its counters are only kept in the total.
+	var s Stats
+	retired := loop(1, 0, 50)
+	retired.InboundBytes, retired.OutboundBytes, retired.PendingTasks, retired.InflightOffloads = 0, 0, 0, 0
+	retired.OutboundHighWater, retired.Latency = 0, 0
+	s.EventLoops = []EventLoopStats{loop(0, 2, 10), loop(2, 1, 20)}
+	s.Total = retired
+	s.Total.Index = -1
+	for _, ls := range s.EventLoops {
+		s.Total.add(ls)
+	}
+	s.WorkerPool = WorkerPoolStats{Capacity: 16, Running: 3, Rejected: 9}
+
+	var buf bytes.Buffer
+	if err := s.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	golden := filepath.Join("testdata", "prometheus.golden")
+	if *update {
+		if err := ioutil.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("expect the metrics in %s but got:\n%s", golden, buf.Bytes())
+	}
+}